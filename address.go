@@ -0,0 +1,592 @@
+package mimestream
+
+import (
+	"fmt"
+	"mime"
+	"net/textproto"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/idna"
+)
+
+// ErrAddressSyntax for address headers that can't be parsed
+var ErrAddressSyntax = errors.New("Mimestream: Invalid address syntax")
+
+// Address is a mailbox like "John Doe <john@example.com>" (RFC 5322)
+type Address struct {
+	// Name is the decoded display name (optional)
+	Name string
+
+	// Address is the addr-spec, local@domain, without quotes. The domain is
+	// kept as written, see ASCII and Unicode.
+	Address string
+
+	// Group is the name of the group the address is listed in, if any. An
+	// empty group ("undisclosed-recipients:;") is an Address with only Group.
+	Group string
+}
+
+// AddressList is the value of an address header like To or Cc
+type AddressList []Address
+
+// ParseAddress parses a single mailbox
+func ParseAddress(s string) (a Address, err error) {
+	var list AddressList
+	list, err = ParseAddressList(s)
+	if err != nil {
+		return
+	}
+	if len(list) != 1 || list[0].Address == "" {
+		return a, errors.Wrap(ErrAddressSyntax, fmt.Sprintf("expected a single address in %q", s))
+	}
+	return list[0], nil
+}
+
+// ParseAddressList parses an address header value. Like most mail clients it
+// is lenient: empty list entries, unquoted dots and @ in display names, routes,
+// missing closing brackets and semicolons are accepted, RFC 2047 encoded words
+// in names are decoded and UTF-8 is allowed anywhere (RFC 6532). A comment is
+// used as the name of an address without one: "john@example.com (John)".
+func ParseAddressList(s string) (list AddressList, err error) {
+	p := &addressParser{s: s}
+	for {
+		p.skipCFWS()
+		if p.pos >= len(p.s) {
+			return
+		}
+
+		// obs-addr-list allows empty entries
+		if p.consume(',') {
+			continue
+		}
+
+		var addrs []Address
+		addrs, err = p.address()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, addrs...)
+
+		p.skipCFWS()
+		if p.pos < len(p.s) && !p.consume(',') {
+			return nil, p.errorf("expected a comma")
+		}
+	}
+}
+
+// AddressHeader parses every value of the header key (like "To") as one list
+func AddressHeader(header textproto.MIMEHeader, key string) (AddressList, error) {
+	return ParseAddressList(strings.Join(header[textproto.CanonicalMIMEHeaderKey(key)], ", "))
+}
+
+// SetAddressHeader sets the header key to the list, encoded and folded ready to
+// be written. An empty list removes the header.
+func SetAddressHeader(header textproto.MIMEHeader, key string, list AddressList) {
+	if len(list) == 0 {
+		header.Del(key)
+		return
+	}
+	header.Set(key, list.fold(len(key)+2))
+}
+
+// ASCII is the addr-spec with an internationalized domain converted to
+// punycode (IDNA). The local part can only be sent as it is, so a non-ASCII
+// local part needs SMTPUTF8.
+func (a Address) ASCII() (string, error) {
+	if hasControl(a.Address) {
+		return "", errors.Wrap(ErrAddressSyntax, fmt.Sprintf("control character in %q", a.Address))
+	}
+
+	local, domain := splitAddress(a.Address)
+	if domain == "" || strings.HasPrefix(domain, "[") {
+		return a.Address, nil
+	}
+
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("invalid domain %q", domain))
+	}
+	return local + "@" + ascii, nil
+}
+
+// Unicode is the addr-spec with a punycode domain converted back to Unicode,
+// for display
+func (a Address) Unicode() string {
+	local, domain := splitAddress(a.Address)
+	if domain == "" || strings.HasPrefix(domain, "[") {
+		return a.Address
+	}
+
+	unicode, err := idna.Display.ToUnicode(domain)
+	if err != nil {
+		return a.Address
+	}
+	return local + "@" + unicode
+}
+
+// String formats the mailbox for a header: the name is quoted or RFC 2047
+// encoded as needed and the domain is in punycode unless the local part needs
+// SMTPUTF8 anyway. The Group is ignored, see AddressList.String.
+func (a Address) String() string {
+	spec := a.addrSpec()
+	if a.Name == "" {
+		return spec
+	}
+	return formatPhrase(a.Name) + " <" + spec + ">"
+}
+
+// addrSpec quoted as needed. Control characters are left out, they could end
+// the header (see AddressList.Check).
+func (a Address) addrSpec() string {
+	local, domain := splitAddress(strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, a.Address))
+	if !isDotAtom(local) {
+		local = quoteString(local)
+	}
+	if domain == "" {
+		return local
+	}
+
+	if isASCII(local) && !strings.HasPrefix(domain, "[") {
+		if ascii, err := idna.Lookup.ToASCII(domain); err == nil {
+			domain = ascii
+		}
+	}
+	return local + "@" + domain
+}
+
+// String formats the list for a header, on a single line
+func (l AddressList) String() string {
+	return strings.Join(l.items(), ", ")
+}
+
+// Check that every address and group name can be written: control characters
+// (like CR and LF) are an ErrAddressSyntax
+func (l AddressList) Check() error {
+	for _, a := range l {
+		for _, s := range []string{a.Address, a.Group} {
+			if hasControl(s) {
+				return errors.Wrap(ErrAddressSyntax, fmt.Sprintf("control character in %q", s))
+			}
+		}
+	}
+	return nil
+}
+
+// Addresses are the addr-specs of the list (as returned by Address.ASCII),
+// ready for Sender.Send
+func (l AddressList) Addresses() (addrs []string, err error) {
+	for _, a := range l {
+		if a.Address == "" {
+			continue
+		}
+
+		var addr string
+		addr, err = a.ASCII()
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return
+}
+
+// items are the formatted mailboxes, with the members of a group together
+func (l AddressList) items() (items []string) {
+	for i := 0; i < len(l); i++ {
+		if l[i].Group == "" {
+			items = append(items, l[i].String())
+			continue
+		}
+
+		var members []string
+		group := l[i].Group
+		for ; i < len(l) && l[i].Group == group; i++ {
+			if l[i].Address != "" {
+				members = append(members, l[i].String())
+			}
+		}
+		i--
+
+		item := formatPhrase(group) + ":"
+		if len(members) > 0 {
+			item += " " + strings.Join(members, ", ")
+		}
+		items = append(items, item+";")
+	}
+	return
+}
+
+// fold the list into lines of at most 78 characters where possible, the first
+// line starting after offset characters
+func (l AddressList) fold(offset int) string {
+	var b strings.Builder
+	line := offset
+	for i, item := range l.items() {
+		if i > 0 {
+			b.WriteString(",")
+			line++
+
+			if line+1+len(item) > 78 {
+				b.WriteString("\r\n")
+				line = 0
+			}
+			b.WriteString(" ")
+			line++
+		}
+		b.WriteString(item)
+		line += len(item)
+	}
+	return b.String()
+}
+
+// addressParser reads an address list one token at a time
+type addressParser struct {
+	s   string
+	pos int
+
+	// The last comment skipped
+	comment string
+}
+
+func (p *addressParser) errorf(msg string) error {
+	return errors.Wrap(ErrAddressSyntax, fmt.Sprintf("%s at %d in %q", msg, p.pos, p.s))
+}
+
+func (p *addressParser) consume(c byte) bool {
+	if p.pos < len(p.s) && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// atEnd of a list entry (or group member)
+func (p *addressParser) atEnd() bool {
+	p.skipCFWS()
+	return p.pos >= len(p.s) || p.s[p.pos] == ',' || p.s[p.pos] == ';'
+}
+
+// skipCFWS skips whitespace and comments
+func (p *addressParser) skipCFWS() {
+	for p.pos < len(p.s) {
+		switch p.s[p.pos] {
+		case ' ', '\t', '\r', '\n':
+			p.pos++
+		case '(':
+			p.skipComment()
+		default:
+			return
+		}
+	}
+}
+
+// skipComment skips a (possibly nested) comment. An unterminated comment runs
+// to the end.
+func (p *addressParser) skipComment() {
+	var b strings.Builder
+	depth := 0
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		p.pos++
+
+		switch {
+		case c == '\\' && p.pos < len(p.s):
+			b.WriteByte(p.s[p.pos])
+			p.pos++
+			continue
+		case c == '(':
+			depth++
+			if depth == 1 {
+				continue
+			}
+		case c == ')':
+			depth--
+			if depth == 0 {
+				p.comment = strings.TrimSpace(b.String())
+				return
+			}
+		}
+		b.WriteByte(c)
+	}
+	p.comment = strings.TrimSpace(b.String())
+}
+
+// take the longest run of bytes matching ok
+func (p *addressParser) take(ok func(c byte) bool) string {
+	start := p.pos
+	for p.pos < len(p.s) && ok(p.s[p.pos]) {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// quotedString without the quotes. An unterminated one runs to the end.
+func (p *addressParser) quotedString() string {
+	var b strings.Builder
+	p.pos++
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		p.pos++
+
+		switch {
+		case c == '"':
+			return b.String()
+		case c == '\\' && p.pos < len(p.s):
+			c = p.s[p.pos]
+			p.pos++
+		case c == '\r' || c == '\n':
+			// Folding
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// word is an atom or a quoted string
+func (p *addressParser) word() (string, bool) {
+	p.skipCFWS()
+	if p.pos < len(p.s) && p.s[p.pos] == '"' {
+		return p.quotedString(), true
+	}
+	w := p.take(isAtext)
+	return w, w != ""
+}
+
+// phrase is a display name, decoded
+func (p *addressParser) phrase() string {
+	var words []string
+	for {
+		p.skipCFWS()
+		if p.pos >= len(p.s) {
+			break
+		}
+
+		if p.s[p.pos] == '"' {
+			words = append(words, p.quotedString())
+			continue
+		}
+
+		// obs-phrase allows dots, and @ is often left unquoted
+		w := p.take(func(c byte) bool { return isAtext(c) || c == '.' || c == '@' })
+		if w == "" {
+			break
+		}
+		words = append(words, w)
+	}
+	return decodeWords(strings.Join(words, " "))
+}
+
+// address is a mailbox or the members of a group
+func (p *addressParser) address() (list []Address, err error) {
+	start := p.pos
+
+	name := p.phrase()
+	p.skipCFWS()
+	if name == "" || !p.consume(':') {
+		p.pos = start
+
+		var a Address
+		a, err = p.mailbox()
+		return []Address{a}, err
+	}
+
+	for {
+		p.skipCFWS()
+		if p.consume(';') || p.pos >= len(p.s) {
+			break
+		}
+		if p.consume(',') {
+			continue
+		}
+
+		var a Address
+		a, err = p.mailbox()
+		if err != nil {
+			return
+		}
+		a.Group = name
+		list = append(list, a)
+
+		p.skipCFWS()
+		if p.pos < len(p.s) && p.s[p.pos] != ',' && p.s[p.pos] != ';' {
+			return nil, p.errorf("expected a comma")
+		}
+	}
+
+	if len(list) == 0 {
+		list = append(list, Address{Group: name})
+	}
+	return
+}
+
+// mailbox is an addr-spec or a name with an angle-addr
+func (p *addressParser) mailbox() (a Address, err error) {
+	start := p.pos
+	p.comment = ""
+
+	if spec, err := p.addrSpec(); err == nil && p.atEnd() {
+		return Address{Name: decodeWords(p.comment), Address: spec}, nil
+	}
+
+	p.pos = start
+	a.Name = p.phrase()
+	p.skipCFWS()
+	if !p.consume('<') {
+		return a, p.errorf("expected an address")
+	}
+
+	// obs-route: <@relay.example,@other.example:john@example.com>
+	p.skipCFWS()
+	if p.pos < len(p.s) && p.s[p.pos] == '@' {
+		i := strings.IndexByte(p.s[p.pos:], ':')
+		if i < 0 {
+			return a, p.errorf("invalid route")
+		}
+		p.pos += i + 1
+	}
+
+	a.Address, err = p.addrSpec()
+	if err != nil {
+		return
+	}
+
+	// A missing > is forgiven at the end of the entry
+	p.skipCFWS()
+	if !p.consume('>') && !p.atEnd() {
+		return a, p.errorf("expected >")
+	}
+	return
+}
+
+// addrSpec is local@domain, allowing comments and whitespace around the dots
+// (obs-local-part and obs-domain)
+func (p *addressParser) addrSpec() (string, error) {
+	var local []string
+	for {
+		w, ok := p.word()
+		if !ok {
+			return "", p.errorf("expected a local part")
+		}
+		local = append(local, w)
+
+		p.skipCFWS()
+		if !p.consume('.') {
+			break
+		}
+	}
+
+	if !p.consume('@') {
+		return "", p.errorf("expected @")
+	}
+
+	p.skipCFWS()
+	if p.pos < len(p.s) && p.s[p.pos] == '[' {
+		i := strings.IndexByte(p.s[p.pos:], ']')
+		if i < 0 {
+			return "", p.errorf("unterminated domain literal")
+		}
+		literal := p.s[p.pos : p.pos+i+1]
+		p.pos += i + 1
+		return strings.Join(local, ".") + "@" + literal, nil
+	}
+
+	var domain []string
+	for {
+		p.skipCFWS()
+		label := p.take(isAtext)
+		if label == "" {
+			return "", p.errorf("expected a domain")
+		}
+		domain = append(domain, label)
+
+		p.skipCFWS()
+		if !p.consume('.') {
+			break
+		}
+	}
+	return strings.Join(local, ".") + "@" + strings.Join(domain, "."), nil
+}
+
+// isAtext for the characters of an atom. UTF-8 is allowed (RFC 6532).
+func isAtext(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c >= 0x80:
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) >= 0
+}
+
+// isDotAtom reports if s can be written without quotes as a local part
+func isDotAtom(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, atom := range strings.Split(s, ".") {
+		if atom == "" {
+			return false
+		}
+		for i := 0; i < len(atom); i++ {
+			if !isAtext(atom[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// formatPhrase for a display name: as it is, quoted or RFC 2047 encoded
+func formatPhrase(s string) string {
+	if !isASCII(s) {
+		return mime.QEncoding.Encode("utf-8", s)
+	}
+
+	if hasControl(s) {
+		return mime.QEncoding.Encode("utf-8", s)
+	}
+
+	for _, word := range strings.Split(s, " ") {
+		if strings.HasPrefix(word, "=?") || strings.Contains(word, ".") || !isDotAtom(word) {
+			return quoteString(s)
+		}
+	}
+	return s
+}
+
+// hasControl reports if s has an ASCII control character
+func hasControl(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+func quoteString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// decodeWords decodes RFC 2047 encoded words, leaving anything invalid alone
+func decodeWords(s string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return decoded
+}
+
+// splitAddress at the last @
+func splitAddress(addr string) (local, domain string) {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return addr, ""
+	}
+	return addr[:i], addr[i+1:]
+}
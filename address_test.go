@@ -0,0 +1,186 @@
+package mimestream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseAddressList(t *testing.T) {
+	tests := []struct {
+		in   string
+		want AddressList
+	}{
+		{`John Doe <john@example.com>`, AddressList{{Name: "John Doe", Address: "john@example.com"}}},
+		{`"Doe, John" <john@example.com>, jane@example.com`, AddressList{
+			{Name: "Doe, John", Address: "john@example.com"},
+			{Address: "jane@example.com"},
+		}},
+		{`john@example.com (John Doe)`, AddressList{{Name: "John Doe", Address: "john@example.com"}}},
+		{`=?utf-8?q?J=C3=B6rg?= =?utf-8?q?_M=C3=BCller?= <jorg@example.com>`, AddressList{{Name: "Jörg Müller", Address: "jorg@example.com"}}},
+		{`John Q. Public <john.q (middle) . public@example . com>`, AddressList{{Name: "John Q. Public", Address: "john.q.public@example.com"}}},
+		{`, , john@example.com,,`, AddressList{{Address: "john@example.com"}}},
+		{`<@relay.example:john@example.com>`, AddressList{{Address: "john@example.com"}}},
+		{`john@example.com <john@example.com>`, AddressList{{Name: "john@example.com", Address: "john@example.com"}}},
+		{`"john doe"@example.com`, AddressList{{Address: "john doe@example.com"}}},
+		{`Friends: john@example.com, Jane <jane@example.com>;, boss@example.com`, AddressList{
+			{Address: "john@example.com", Group: "Friends"},
+			{Name: "Jane", Address: "jane@example.com", Group: "Friends"},
+			{Address: "boss@example.com"},
+		}},
+		{`undisclosed-recipients:;`, AddressList{{Group: "undisclosed-recipients"}}},
+		{`José <josé@bücher.example>`, AddressList{{Name: "José", Address: "josé@bücher.example"}}},
+		{`John <john@example.com`, AddressList{{Name: "John", Address: "john@example.com"}}},
+	}
+
+	for _, test := range tests {
+		got, err := ParseAddressList(test.in)
+		if err != nil {
+			t.Errorf("Invalid error for %q: %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Invalid list for %q:\n\tGot:%+v\n\tWant:%+v\n", test.in, got, test.want)
+		}
+	}
+
+	for _, in := range []string{`John Doe`, `<john>`, `john@`, `a@b c@d`} {
+		_, err := ParseAddressList(in)
+		if errors.Cause(err) != ErrAddressSyntax {
+			t.Errorf("Invalid error for %q:\n\tGot:%v\n\tWant:%v\n", in, err, ErrAddressSyntax)
+		}
+	}
+}
+
+func TestFormatAddressList(t *testing.T) {
+	list := AddressList{
+		{Name: "Doe, John", Address: "john@example.com"},
+		{Name: "Jörg", Address: "jorg@bücher.example"},
+		{Name: "José", Address: "josé@bücher.example"},
+		{Address: "john doe@example.com"},
+		{Name: "A", Address: "a@example.com", Group: "Team"},
+		{Address: "b@example.com", Group: "Team"},
+		{Group: "undisclosed-recipients"},
+	}
+
+	want := `"Doe, John" <john@example.com>, =?utf-8?q?J=C3=B6rg?= <jorg@xn--bcher-kva.example>, ` +
+		`=?utf-8?q?Jos=C3=A9?= <josé@bücher.example>, "john doe"@example.com, ` +
+		`Team: A <a@example.com>, b@example.com;, undisclosed-recipients:;`
+	if list.String() != want {
+		t.Errorf("Invalid list:\n\tGot:%s\n\tWant:%s\n", list.String(), want)
+	}
+
+	// Formatting and parsing again gives the same list (with the ASCII domain)
+	got, err := ParseAddressList(list.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	list[1].Address = "jorg@xn--bcher-kva.example"
+	if !reflect.DeepEqual(got, list) {
+		t.Errorf("Invalid round trip:\n\tGot:%+v\n\tWant:%+v\n", got, list)
+	}
+
+	if got[1].Unicode() != "jorg@bücher.example" {
+		t.Errorf("Invalid unicode address:\n\tGot:%s\n\tWant:%s\n", got[1].Unicode(), "jorg@bücher.example")
+	}
+
+	addrs, err := list[:3].Addresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantAddrs := []string{"john@example.com", "jorg@xn--bcher-kva.example", "josé@xn--bcher-kva.example"}
+	if !reflect.DeepEqual(addrs, wantAddrs) {
+		t.Errorf("Invalid addresses:\n\tGot:%v\n\tWant:%v\n", addrs, wantAddrs)
+	}
+}
+
+func TestMessageAddresses(t *testing.T) {
+	var to AddressList
+	for _, name := range []string{"Alice", "Bob", "Carol", "Dave", "Erin", "Frank"} {
+		to = append(to, Address{Name: name, Address: strings.ToLower(name) + "@example.com"})
+	}
+
+	m := Message{
+		From: AddressList{{Name: "Jörg", Address: "jorg@example.com"}},
+		To:   to,
+	}
+
+	var buf bytes.Buffer
+	err := m.Into(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := m.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(buf.Len()) {
+		t.Errorf("Invalid size:\n\tGot:%v\n\tWant:%v\n", size, buf.Len())
+	}
+
+	// The To header and its continuation lines
+	raw := buf.String()
+	for _, line := range strings.Split(raw[:strings.Index(raw, "\r\n\r\n")], "\r\n") {
+		if (strings.HasPrefix(line, "To:") || strings.HasPrefix(line, " ")) && len(line) > 78 {
+			t.Errorf("Invalid folding:\n\tGot:%q\n", line)
+		}
+	}
+
+	header, err := textproto.NewReader(bufioReader(&buf)).ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotTo, err := AddressHeader(header, "to")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotTo, to) {
+		t.Errorf("Invalid To:\n\tGot:%+v\n\tWant:%+v\n", gotTo, to)
+	}
+
+	from, err := AddressHeader(header, "From")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(from) != 1 || from[0].Name != "Jörg" {
+		t.Errorf("Invalid From:\n\tGot:%+v\n\tWant:%v\n", from, "Jörg")
+	}
+}
+
+func TestAddressControlCharacters(t *testing.T) {
+	for _, to := range []AddressList{
+		{{Name: "x", Address: "john@example.com\r\nBcc: evil@attacker.example"}},
+		{{Address: "john\r\nBcc: evil@attacker.example@example.com"}},
+		{{Group: "Team\r\nBcc: evil@attacker.example"}},
+	} {
+		m := Message{To: to}
+		err := m.Into(ioutil.Discard)
+		if errors.Cause(err) != ErrAddressSyntax {
+			t.Errorf("Invalid error for %q:\n\tGot:%v\n\tWant:%v\n", to, err, ErrAddressSyntax)
+		}
+
+		_, err = m.Size()
+		if errors.Cause(err) != ErrAddressSyntax {
+			t.Errorf("Invalid size error for %q:\n\tGot:%v\n\tWant:%v\n", to, err, ErrAddressSyntax)
+		}
+
+		// Formatted without the check, the header is still a single one
+		header := textproto.MIMEHeader{}
+		SetAddressHeader(header, "To", to)
+		if strings.ContainsAny(header.Get("To"), "\r\n") {
+			t.Errorf("Invalid To:\n\tGot:%q\n", header.Get("To"))
+		}
+	}
+
+	_, err := (AddressList{{Address: "john@example.com\r\nRCPT TO:<evil@attacker.example>"}}).Addresses()
+	if errors.Cause(err) != ErrAddressSyntax {
+		t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, ErrAddressSyntax)
+	}
+}
@@ -1,66 +1,79 @@
 package mimestream
 
 import (
-	"bytes"
-	"fmt"
-	"io"
+	"mime"
 	"mime/multipart"
 	"net/textproto"
-
-	"github.com/pkg/errors"
 )
 
-// Alternative multipart/mime part
+// Alternative multipart/mime part. When it has an HTML Text but no plain text
+// one, a text/plain version of the HTML (see HTMLToText) is added first for
+// text-only clients, unless Writer.NoPlainText is set.
 type Alternative struct {
 	Parts Parts
 }
 
 func (p Alternative) Add(w *multipart.Writer) (err error) {
+	return p.add(defaultState(), "", w)
+}
 
-	if len(p.Parts) == 0 {
-		return
-	}
-
-	buf := &bytes.Buffer{}
-	w2 := multipart.NewWriter(buf)
-
-	for _, p := range p.Parts {
-		err = p.Add(w2)
-		if err != nil {
-			err = errors.Wrap(err, fmt.Sprintf("failed to add %T part %v", p, p))
-			return
-		}
+func (p Alternative) add(s *writeState, path string, w *multipart.Writer) error {
+	parts, err := p.withPlainText(s)
+	if err != nil {
+		return appendError(err, s.closed(closeParts(p.Parts)))
 	}
+	return s.addMultipart(w, path, MultipartAlternative, parts)
+}
 
-	err = w2.Close()
+func (p Alternative) partSize(s *writeState, path string) (header textproto.MIMEHeader, size int64, err error) {
+	parts, err := p.withPlainText(s)
 	if err != nil {
 		return
 	}
+	return multipartPartSize(s, path, MultipartAlternative, parts)
+}
 
-	contentType := fmt.Sprintf("%s; boundary=%s", MultipartAlternative, w2.Boundary())
-
-	header := textproto.MIMEHeader{
-		"Content-Type": []string{contentType},
+// withPlainText returns the parts with a text/plain version of the first HTML
+// Text prepended, as the least preferred alternative comes first (RFC 2046)
+func (p Alternative) withPlainText(s *writeState) (Parts, error) {
+	if s.opts.NoPlainText {
+		return p.Parts, nil
 	}
 
-	var part io.Writer
-	part, err = w.CreatePart(header)
-	if err != nil {
-		return err
-	}
+	var htmlText *Text
+	for _, part := range p.Parts {
+		t, ok := part.(Text)
+		if !ok {
+			continue
+		}
 
-	// How much data are we going to copy?
-	bl := int64(buf.Len())
+		mediaType := TextPlain
+		if t.ContentType != "" {
+			mediaType = t.ContentType
+		}
+		mediaType, _, _ = mime.ParseMediaType(mediaType)
 
-	var n int64
-	n, err = io.Copy(part, buf)
-	if err != nil {
-		return
+		switch mediaType {
+		case "text/plain":
+			return p.Parts, nil
+		case "text/html":
+			if htmlText == nil {
+				htmlText = &t
+			}
+		}
 	}
 
-	if n != bl {
-		return ErrPartialWrite
+	if htmlText == nil {
+		return p.Parts, nil
 	}
 
-	return
+	text, err := HTMLToText(htmlText.Text)
+	if err != nil {
+		return nil, err
+	}
+	return append(Parts{Text{ContentType: TextPlain, Text: text}}, p.Parts...), nil
+}
+
+func (p Alternative) closeSources() error {
+	return closeParts(p.Parts)
 }
@@ -0,0 +1,263 @@
+package mimestream
+
+import (
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// MaximumBodySize is the most text (or HTML) ReadBody keeps in memory
+var MaximumBodySize int64 = 10 * 1024 * 1024
+
+var ErrMaximumBodySize = errors.New("Mimestream: Maximum body size reached")
+
+// Body is the text of a message as a mail client would show it
+type Body struct {
+	// Text and HTML are the preferred text/plain and text/html bodies,
+	// converted to UTF-8. Either can be empty.
+	Text string
+	HTML string
+
+	// Attachments are all the other leaf parts, including inline images and
+	// the resources of multipart/related bodies, in part order
+	Attachments []Attachment
+}
+
+// Attachment is a leaf part that is not a body
+type Attachment struct {
+	// Path of the part (see BoundaryFunc)
+	Path   string
+	Header textproto.MIMEHeader
+
+	// ContentType is the media type without parameters
+	ContentType string
+
+	// Name is the filename, if any
+	Name string
+
+	// ContentID without the angle brackets, for cid: references
+	ContentID string
+
+	// Inline is false only for parts with an attachment disposition
+	Inline bool
+
+	// Size of the decoded body. Only known once the body was read, so it
+	// is always 0 in the Attachment passed to the ReadBody handler.
+	Size int64
+}
+
+// ReadBody walks the message in r and picks the bodies a mail client would
+// show, following RFC 2046:
+//
+//   - multipart/alternative: the last alternative with text/plain (or
+//     text/html) wins
+//   - multipart/related: the bodies come from the root part (the "start"
+//     parameter or else the first part), the other parts are attachments
+//   - multipart/mixed and others: bodies are shown one after another, so
+//     every inline text/plain (or text/html) part is appended
+//
+// Parts with an attachment disposition or a filename are never bodies. The
+// handler is called with the decoded body of every attachment (optional, nil
+// skips them).
+func ReadBody(r io.Reader, handler func(Attachment, io.Reader) error) (body *Body, err error) {
+	tp := textproto.NewReader(bufioReader(r))
+
+	var header textproto.MIMEHeader
+	header, err = tp.ReadMIMEHeader()
+	if err != nil {
+		return
+	}
+
+	br := &bodyReader{handler: handler}
+
+	var b bodies
+	b, err = br.entity("", header, contentDecoderReader(header, tp.R), 0, false)
+	if err != nil {
+		return
+	}
+
+	return &Body{Text: b.text, HTML: b.html, Attachments: br.attachments}, nil
+}
+
+// bodies found in an entity
+type bodies struct {
+	text, html       string
+	hasText, hasHTML bool
+}
+
+// add the bodies shown after b
+func (b *bodies) add(next bodies) {
+	if next.hasText {
+		if b.hasText && !strings.HasSuffix(b.text, "\n") {
+			b.text += "\n"
+		}
+		b.text += next.text
+		b.hasText = true
+	}
+	if next.hasHTML {
+		b.html += next.html
+		b.hasHTML = true
+	}
+}
+
+// bodyReader collects the attachments while walking a message
+type bodyReader struct {
+	handler     func(Attachment, io.Reader) error
+	attachments []Attachment
+}
+
+// entity returns the bodies of a MIME entity. With attach every leaf is an
+// attachment (the resources of a multipart/related).
+func (br *bodyReader) entity(path string, header textproto.MIMEHeader, body io.Reader, level int, attach bool) (b bodies, err error) {
+
+	// Protect against bad actors
+	if level > MaximumMultipartDepth {
+		return b, ErrMaximumMultipartDepth
+	}
+
+	ct, params, err := parseContentType(header)
+	if err != nil {
+		ct, err = "application/octet-stream", nil
+	}
+
+	if !strings.HasPrefix(ct, "multipart/") {
+		return br.leaf(path, header, ct, params, body, attach)
+	}
+
+	if _, ok := params["boundary"]; !ok {
+		return b, ErrMissingBoundary
+	}
+
+	mr := multipart.NewReader(body, params["boundary"])
+
+	// The root of a related is the start part or else the first one
+	start := strings.Trim(params["start"], "<> ")
+
+	var partsCounter int
+	var p *multipart.Part
+	for {
+		p, err = mr.NextPart()
+		if err == io.EOF {
+			return b, nil
+		}
+		if err != nil {
+			return
+		}
+
+		// Protect against bad actors
+		partsCounter++
+		if partsCounter > MaximumPartsPerMultipart {
+			return b, ErrMaximumPartsPerMultipart
+		}
+
+		childAttach := attach
+		if ct == "multipart/related" {
+			if start == "" {
+				childAttach = attach || partsCounter > 1
+			} else {
+				childAttach = attach || contentID(p.Header) != start
+			}
+		}
+
+		var child bodies
+		child, err = br.entity(childPath(path, partsCounter-1), p.Header, contentDecoderReader(p.Header, p), level+1, childAttach)
+		if err != nil {
+			return
+		}
+
+		// Later alternatives are preferred
+		if ct == "multipart/alternative" {
+			if child.hasText {
+				b.text, b.hasText = child.text, true
+			}
+			if child.hasHTML {
+				b.html, b.hasHTML = child.html, true
+			}
+			continue
+		}
+
+		b.add(child)
+	}
+}
+
+// leaf reads a text body or hands the part to the attachment handler
+func (br *bodyReader) leaf(path string, header textproto.MIMEHeader, ct string, params map[string]string, body io.Reader, attach bool) (b bodies, err error) {
+	disposition, _, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	name := partFilename(header)
+
+	if !attach && disposition != "attachment" && name == "" && (ct == "text/plain" || ct == "text/html") {
+		var text string
+		text, err = readText(body, params["charset"])
+		if ct == "text/plain" {
+			b.text, b.hasText = text, true
+		} else {
+			b.html, b.hasHTML = text, true
+		}
+		return
+	}
+
+	a := Attachment{
+		Path:        path,
+		Header:      header,
+		ContentType: ct,
+		Name:        name,
+		ContentID:   contentID(header),
+		Inline:      disposition != "attachment",
+	}
+
+	c := &byteCounter{}
+	r := io.TeeReader(body, c)
+
+	if br.handler != nil {
+		err = br.handler(a, r)
+		if err != nil {
+			return
+		}
+	}
+
+	// Skip whatever the handler did not read
+	_, err = io.Copy(ioutil.Discard, r)
+	a.Size = c.n
+
+	br.attachments = append(br.attachments, a)
+	return
+}
+
+// readText reads a body up to MaximumBodySize and converts it to UTF-8. Bodies
+// in an unknown charset are returned as they are.
+func readText(body io.Reader, charset string) (string, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(body, MaximumBodySize+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) > MaximumBodySize {
+		return "", ErrMaximumBodySize
+	}
+
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii":
+		return string(data), nil
+	}
+
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return string(data), nil
+	}
+
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return string(data), nil
+	}
+	return string(decoded), nil
+}
+
+// contentID of the part without the angle brackets
+func contentID(header textproto.MIMEHeader) string {
+	return strings.Trim(header.Get("Content-Id"), "<> ")
+}
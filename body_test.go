@@ -0,0 +1,127 @@
+package mimestream
+
+import (
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var bodyMessage = strings.Replace(`From: a@example.com
+Content-Type: multipart/mixed; boundary=mixed
+
+--mixed
+Content-Type: multipart/related; boundary=related; start="<root@example.com>"
+
+--related
+Content-Type: image/png
+Content-ID: <logo@example.com>
+Content-Transfer-Encoding: base64
+
+iVBORw0KGgo=
+--related
+Content-Type: multipart/alternative; boundary=alt
+Content-ID: <root@example.com>
+
+--alt
+Content-Type: text/plain; charset=iso-8859-1
+Content-Transfer-Encoding: quoted-printable
+
+Caf=E9
+--alt
+Content-Type: text/html; charset=utf-8
+
+<p>Caf=C3=A9 <img src="cid:logo@example.com"></p>
+--alt
+Content-Type: application/x-unsupported
+
+ignored by old clients
+--alt--
+--related--
+--mixed
+Content-Type: text/plain
+
+Sent from my phone
+--mixed
+Content-Type: application/pdf; name="invoice.pdf"
+Content-Disposition: attachment; filename="invoice.pdf"
+
+%PDF-1.4
+--mixed
+Content-Type: text/plain
+Content-Disposition: inline; filename="notes.txt"
+
+notes
+--mixed--
+`, "\n", "\r\n", -1)
+
+func TestReadBody(t *testing.T) {
+	handled := map[string]string{}
+	body, err := ReadBody(strings.NewReader(bodyMessage), func(a Attachment, r io.Reader) error {
+		b, err := ioutil.ReadAll(r)
+		handled[a.Path] = string(b)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body.Text != "Café\nSent from my phone" {
+		t.Errorf("Invalid text:\n\tGot:%q\n\tWant:%q\n", body.Text, "Café\nSent from my phone")
+	}
+
+	// The html alternative is not quoted-printable so =C3=A9 stays as it is
+	if body.HTML != `<p>Caf=C3=A9 <img src="cid:logo@example.com"></p>` {
+		t.Errorf("Invalid html:\n\tGot:%q\n", body.HTML)
+	}
+
+	type summary struct {
+		Path, ContentType, Name, ContentID string
+		Inline                             bool
+		Size                               int64
+	}
+
+	var got []summary
+	for _, a := range body.Attachments {
+		got = append(got, summary{a.Path, a.ContentType, a.Name, a.ContentID, a.Inline, a.Size})
+	}
+
+	want := []summary{
+		{"1.1", "image/png", "", "logo@example.com", true, 8},
+		{"1.2.3", "application/x-unsupported", "", "", true, 22},
+		{"3", "application/pdf", "invoice.pdf", "", false, 8},
+		{"4", "text/plain", "notes.txt", "", true, 5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Invalid attachments:\n\tGot:%v\n\tWant:%v\n", got, want)
+	}
+
+	if handled["3"] != "%PDF-1.4" {
+		t.Errorf("Invalid handled attachment:\n\tGot:%q\n\tWant:%q\n", handled["3"], "%PDF-1.4")
+	}
+}
+
+func TestReadBodyAlternativeOrder(t *testing.T) {
+	message := strings.Replace(`Content-Type: multipart/alternative; boundary=alt
+
+--alt
+Content-Type: text/plain
+
+first
+--alt
+Content-Type: text/plain
+
+second
+--alt--
+`, "\n", "\r\n", -1)
+
+	body, err := ReadBody(strings.NewReader(message), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body.Text != "second" || body.HTML != "" || len(body.Attachments) != 0 {
+		t.Errorf("Invalid body:\n\tGot:%+v\n\tWant:%v\n", body, "second")
+	}
+}
@@ -0,0 +1,190 @@
+package mimestream
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// MaximumDataURISize is the largest part DataURI inlines. References to bigger
+// parts are left as they are.
+var MaximumDataURISize int64 = 1024 * 1024
+
+// ContentIDs maps the Content-ID of parts (without angle brackets) to the URL
+// that replaces their cid: references (RFC 2392) in HTML bodies.
+//
+//	ids := mimestream.ContentIDs{}
+//	body, err := mimestream.ReadBody(r, ids.Handler(mimestream.DataURI))
+//	html := ids.ReplaceString(body.HTML)
+type ContentIDs map[string]string
+
+// Handler returns a ReadBody handler calling resolve for every part with a
+// Content-ID and storing the URL returned. An empty URL leaves the references
+// to that part as they are.
+func (ids ContentIDs) Handler(resolve func(Attachment, io.Reader) (string, error)) func(Attachment, io.Reader) error {
+	return func(a Attachment, body io.Reader) error {
+		if a.ContentID == "" {
+			return nil
+		}
+
+		u, err := resolve(a, body)
+		if err != nil || u == "" {
+			return err
+		}
+
+		ids[a.ContentID] = u
+		return nil
+	}
+}
+
+// DataURI returns the body as a data: URI (RFC 2397), or no URI if it is
+// bigger than MaximumDataURISize
+func DataURI(a Attachment, body io.Reader) (string, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(body, MaximumDataURISize+1))
+	if err != nil || int64(len(data)) > MaximumDataURISize {
+		return "", err
+	}
+
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// url for a cid: reference, if the Content-ID is known
+func (ids ContentIDs) url(ref string) (string, bool) {
+	ref = strings.TrimSpace(ref)
+	if len(ref) < 4 || !strings.EqualFold(ref[:4], "cid:") {
+		return "", false
+	}
+
+	// The Content-ID is URL encoded in the reference
+	cid, err := url.PathUnescape(ref[4:])
+	if err != nil {
+		cid = ref[4:]
+	}
+
+	u, ok := ids[strings.Trim(cid, "<>")]
+	return u, ok
+}
+
+// cssURL matches the url() of a style sheet
+var cssURL = regexp.MustCompile(`(?i)url\(\s*(['"]?)(cid:[^'")\s]+)(['"]?)\s*\)`)
+
+// css with the cid: references of url() replaced
+func (ids ContentIDs) css(s string) string {
+	return cssURL.ReplaceAllStringFunc(s, func(match string) string {
+		m := cssURL.FindStringSubmatch(match)
+		if u, ok := ids.url(m[2]); ok {
+			return "url(" + m[1] + u + m[3] + ")"
+		}
+		return match
+	})
+}
+
+// cidAttributes hold URLs that can point to parts
+var cidAttributes = map[string]bool{
+	"src":        true,
+	"href":       true,
+	"background": true,
+	"poster":     true,
+	"data":       true,
+}
+
+// Replace streams the HTML from r to w with the cid: references replaced, in
+// URL attributes as well as in style attributes and elements. Everything else
+// is copied byte for byte.
+func (ids ContentIDs) Replace(w io.Writer, r io.Reader) (err error) {
+	z := html.NewTokenizer(r)
+
+	var style bool
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() == io.EOF {
+				return nil
+			}
+			return z.Err()
+		}
+
+		raw := z.Raw()
+
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			// Raw is only valid until the next call to Next or Token
+			raw = append([]byte(nil), raw...)
+
+			t := z.Token()
+			style = tt == html.StartTagToken && t.DataAtom == atom.Style
+
+			if ids.replaceAttributes(&t) {
+				_, err = io.WriteString(w, t.String())
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+		case html.EndTagToken:
+			style = false
+
+		case html.TextToken:
+			if style && bytes.Contains(bytes.ToLower(raw), []byte("cid:")) {
+				_, err = io.WriteString(w, ids.css(string(raw)))
+				if err != nil {
+					return
+				}
+				continue
+			}
+		}
+
+		_, err = w.Write(raw)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ReplaceString is Replace for an HTML string
+func (ids ContentIDs) ReplaceString(s string) string {
+	if len(ids) == 0 {
+		return s
+	}
+
+	var buf strings.Builder
+	if err := ids.Replace(&buf, strings.NewReader(s)); err != nil {
+		return s
+	}
+	return buf.String()
+}
+
+// replaceAttributes of the tag and reports if any changed
+func (ids ContentIDs) replaceAttributes(t *html.Token) (changed bool) {
+	for i, a := range t.Attr {
+		key := strings.ToLower(a.Key)
+
+		if cidAttributes[key] {
+			if u, ok := ids.url(a.Val); ok {
+				t.Attr[i].Val = u
+				changed = true
+			}
+			continue
+		}
+
+		if key == "style" {
+			if css := ids.css(a.Val); css != a.Val {
+				t.Attr[i].Val = css
+				changed = true
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,55 @@
+package mimestream
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestContentIDsDataURI(t *testing.T) {
+	ids := ContentIDs{}
+	body, err := ReadBody(strings.NewReader(bodyMessage), ids.Handler(DataURI))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := ids.ReplaceString(body.HTML)
+	want := `<p>Caf=C3=A9 <img src="data:image/png;base64,iVBORw0KGgo="></p>`
+	if got != want {
+		t.Errorf("Invalid html:\n\tGot:%q\n\tWant:%q\n", got, want)
+	}
+}
+
+func TestContentIDsReplace(t *testing.T) {
+	ids := ContentIDs{}
+	handler := ids.Handler(func(a Attachment, body io.Reader) (string, error) {
+		return "/parts/" + a.Path, nil
+	})
+
+	for _, a := range []Attachment{{Path: "2", ContentID: "logo@example.com"}, {Path: "3", ContentID: "bg"}, {Path: "4"}} {
+		err := handler(a, strings.NewReader(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	in := `<HTML><style>body { background: url("cid:bg") }</style>` +
+		`<body class=x><img SRC="CID:logo%40example.com" alt='a &amp; b'>` +
+		`<div style="background-image: url(cid:bg)">` +
+		`<img src="cid:unknown"><a href="https://example.com/?a=1&b=2">link</a></div></body></HTML>`
+
+	want := `<HTML><style>body { background: url("/parts/3") }</style>` +
+		`<body class=x><img src="/parts/2" alt="a &amp; b">` +
+		`<div style="background-image: url(/parts/3)">` +
+		`<img src="cid:unknown"><a href="https://example.com/?a=1&b=2">link</a></div></body></HTML>`
+
+	var buf strings.Builder
+	err := ids.Replace(&buf, strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != want {
+		t.Errorf("Invalid html:\n\tGot:%q\n\tWant:%q\n", buf.String(), want)
+	}
+}
@@ -0,0 +1,66 @@
+package mimestream
+
+import (
+	"strings"
+)
+
+// MultiError is returned when closing sources fails after another error. The
+// first error is the one that stopped the write.
+type MultiError []error
+
+func (e MultiError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap allows errors.Is and errors.As to match any of the errors
+func (e MultiError) Unwrap() []error {
+	return e
+}
+
+// Cause is the first error (see github.com/pkg/errors.Cause)
+func (e MultiError) Cause() error {
+	return e[0]
+}
+
+// appendError adds the errors that are not nil to err
+func appendError(err error, errs ...error) error {
+	var all MultiError
+	for _, e := range append([]error{err}, errs...) {
+		if e == nil {
+			continue
+		}
+		if nested, ok := e.(MultiError); ok {
+			all = append(all, nested...)
+		} else {
+			all = append(all, e)
+		}
+	}
+
+	switch len(all) {
+	case 0:
+		return nil
+	case 1:
+		return all[0]
+	}
+	return all
+}
+
+// sourceCloser is implemented by parts holding sources like File.Closer. The
+// writer closes every source exactly once, whether the part was written or not.
+type sourceCloser interface {
+	closeSources() error
+}
+
+// closeParts closes the sources of every part (and nested part)
+func closeParts(parts Parts) (err error) {
+	for _, part := range parts {
+		if sc, ok := part.(sourceCloser); ok {
+			err = appendError(err, sc.closeSources())
+		}
+	}
+	return
+}
@@ -0,0 +1,168 @@
+package mimestream
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"strings"
+	"testing"
+)
+
+var errInjected = errors.New("injected failure")
+var errClose = errors.New("close failure")
+
+// failingReader fails after returning n bytes
+type failingReader struct {
+	n int
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, errInjected
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	for i := range p {
+		p[i] = 'a'
+	}
+	r.n -= len(p)
+	return len(p), nil
+}
+
+// failingWriter fails once more than n bytes are written
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		return 0, errInjected
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+// trackedCloser counts Close calls and optionally fails
+type trackedCloser struct {
+	n   int
+	err error
+}
+
+func (c *trackedCloser) Close() error {
+	c.n++
+	return c.err
+}
+
+func TestCloseOnEveryPath(t *testing.T) {
+
+	// Builds a tree with a File at every level, the first reading from r
+	tree := func(r io.Reader, closers []*trackedCloser) Parts {
+		return Parts{
+			File{Name: "first.txt", Reader: r, Closer: closers[0]},
+			Text{Text: "text"},
+			File{Name: "second.txt", Reader: strings.NewReader("second"), Closer: closers[1]},
+			Mixed{Parts: Parts{
+				File{Name: "nested.txt", Reader: strings.NewReader("nested"), Closer: closers[2]},
+				Alternative{Parts: Parts{
+					File{Name: "deep.txt", Reader: strings.NewReader("deep"), Closer: closers[3]},
+				}},
+			}},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		reader  io.Reader
+		writer  io.Writer
+		wantErr error
+	}{
+		{"success", strings.NewReader("first"), ioutil.Discard, nil},
+		{"failing reader", &failingReader{n: 10}, ioutil.Discard, errInjected},
+		{"failing writer", strings.NewReader("first"), &failingWriter{n: 10}, errInjected},
+		{"failing writer later", strings.NewReader("first"), &failingWriter{n: 600}, errInjected},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			closers := []*trackedCloser{{}, {}, {}, {}}
+
+			err := tree(test.reader, closers).Into(multipart.NewWriter(test.writer))
+			if !errors.Is(err, test.wantErr) || (test.wantErr == nil && err != nil) {
+				t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, test.wantErr)
+			}
+
+			for i, c := range closers {
+				if c.n != 1 {
+					t.Errorf("Invalid number of Close calls for file %d:\n\tGot:%d\n\tWant:%d\n", i, c.n, 1)
+				}
+			}
+		})
+	}
+}
+
+func TestCloseErrorsAggregated(t *testing.T) {
+	first := &trackedCloser{err: errClose}
+	second := &trackedCloser{err: errClose}
+
+	parts := Parts{
+		File{Name: "first.txt", Reader: &failingReader{}, Closer: first},
+		Mixed{Parts: Parts{
+			File{Name: "second.txt", Reader: strings.NewReader("second"), Closer: second},
+		}},
+	}
+
+	err := parts.Into(multipart.NewWriter(ioutil.Discard))
+
+	errs, ok := err.(MultiError)
+	if !ok {
+		t.Fatalf("Invalid error type:\n\tGot:%T\n\tWant:%T\n", err, MultiError{})
+	}
+
+	if !errors.Is(err, errInjected) || !errors.Is(err, errClose) {
+		t.Errorf("Missing errors:\n\tGot:%v\n", err)
+	}
+
+	// The first file (failed read and Close) and the Close of the second
+	if len(errs) != 2 || !errors.Is(errs[0], errInjected) {
+		t.Errorf("Invalid errors:\n\tGot:%v\n", errs)
+	}
+
+	if first.n != 1 || second.n != 1 {
+		t.Errorf("Invalid number of Close calls:\n\tGot:%d, %d\n\tWant:1, 1\n", first.n, second.n)
+	}
+}
+
+func TestCloseWhenNeverWritten(t *testing.T) {
+	closer := &trackedCloser{}
+	parts := Parts{File{Name: "file.txt", Reader: strings.NewReader("file"), Closer: closer}}
+
+	// An invalid boundary fails before anything is written
+	wr := &Writer{Boundary: func(string) string { return "" }}
+	err := wr.Into(multipart.NewWriter(ioutil.Discard), parts)
+	if err == nil {
+		t.Error("Invalid boundary accepted")
+	}
+
+	if closer.n != 1 {
+		t.Errorf("Invalid number of Close calls:\n\tGot:%d\n\tWant:%d\n", closer.n, 1)
+	}
+
+	// A rejected recipient means the message is never written
+	closer = &trackedCloser{}
+	server := newFakeSMTPServer(t, "nobody@")
+	sender := &Sender{Addr: server.listener.Addr().String()}
+
+	err = sender.Send("john@example.com", []string{"nobody@example.com"}, Message{
+		Parts: Parts{File{Name: "file.txt", Reader: strings.NewReader("file"), Closer: closer}},
+	})
+	if err == nil {
+		t.Error("Rejected recipient accepted")
+	}
+	<-server.done
+
+	if closer.n != 1 {
+		t.Errorf("Invalid number of Close calls:\n\tGot:%d\n\tWant:%d\n", closer.n, 1)
+	}
+}
@@ -0,0 +1,84 @@
+package mimestream
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// contextReader fails with the context error once ctx is done, so copy loops
+// stop between chunks
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (n int, err error) {
+	err = c.ctx.Err()
+	if err != nil {
+		return
+	}
+
+	n, err = c.r.Read(p)
+
+	// A read interrupted by interruptRead
+	if err != nil && c.ctx.Err() != nil {
+		err = c.ctx.Err()
+	}
+	return
+}
+
+// copyContext is io.Copy checking ctx between every chunk. A blocked Read is
+// interrupted if src supports read deadlines (like a net.Conn).
+func copyContext(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	defer interruptRead(ctx, src)()
+	return io.Copy(dst, &contextReader{ctx: ctx, r: src})
+}
+
+// interruptRead makes a blocked Read on r return once ctx is done (if r
+// supports read deadlines). The returned func must be called when done.
+func interruptRead(ctx context.Context, r interface{}) (stop func()) {
+	if pr, ok := r.(*progressReader); ok {
+		r = pr.r
+	}
+
+	d, ok := r.(interface{ SetReadDeadline(time.Time) error })
+	if !ok {
+		return func() {}
+	}
+	return afterDone(ctx, func() {
+		d.SetReadDeadline(time.Now())
+	})
+}
+
+// interruptWrite makes a blocked Write on w return once ctx is done (if w
+// supports write deadlines). The returned func must be called when done.
+func interruptWrite(ctx context.Context, w interface{}) (stop func()) {
+	d, ok := w.(interface{ SetWriteDeadline(time.Time) error })
+	if !ok {
+		return func() {}
+	}
+	return afterDone(ctx, func() {
+		d.SetWriteDeadline(time.Now())
+	})
+}
+
+// afterDone calls f if ctx is done before stop is called
+func afterDone(ctx context.Context, f func()) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			f()
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
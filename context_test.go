@@ -0,0 +1,91 @@
+package mimestream
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+// closeCounter records calls to Close
+type closeCounter struct {
+	n int
+}
+
+func (c *closeCounter) Close() error {
+	c.n++
+	return nil
+}
+
+func TestIntoContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	closers := make([]*closeCounter, 4)
+	for i := range closers {
+		closers[i] = &closeCounter{}
+	}
+
+	slow := func(i int) File {
+		return File{
+			Name:   "slow.txt",
+			Reader: &SlowReader{Reader: mockDataSrc(1024 * 1024), Speed: 10 * time.Millisecond},
+			Closer: closers[i],
+		}
+	}
+
+	parts := Parts{
+		Text{Text: "before"},
+		slow(0),
+		Mixed{Parts: Parts{slow(1), slow(2)}},
+		slow(3),
+	}
+
+	start := time.Now()
+	err := parts.IntoContext(ctx, multipart.NewWriter(ioutil.Discard))
+	if err != context.DeadlineExceeded {
+		t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, context.DeadlineExceeded)
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Cancellation took too long: %v", d)
+	}
+
+	for i, c := range closers {
+		if c.n != 1 {
+			t.Errorf("Invalid number of Close calls for part %d:\n\tGot:%d\n\tWant:%d\n", i, c.n, 1)
+		}
+	}
+}
+
+func TestHandleEmailFromReaderContext(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// The message stalls after the first bytes of the body
+	go func() {
+		io.WriteString(client, "Content-Type: text/plain\r\n\r\nHello")
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	var got []byte
+	err := HandleEmailFromReaderContext(ctx, server, func(header textproto.MIMEHeader, body io.Reader) (err error) {
+		got, err = ioutil.ReadAll(body)
+		return
+	})
+
+	if err != context.Canceled {
+		t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, context.Canceled)
+	}
+
+	if string(got) != "Hello" {
+		t.Errorf("Invalid body:\n\tGot:%q\n\tWant:%q\n", got, "Hello")
+	}
+}
@@ -0,0 +1,107 @@
+package mimestream
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// MaximumLineLength is the SMTP limit on a line of text, excluding the CRLF
+// (RFC 5321 section 4.5.3.1.6)
+var MaximumLineLength = 998
+
+var ErrLineTooLong = errors.New("Mimestream: Line exceeds the maximum SMTP line length")
+
+// dataWriter escapes and terminates an SMTP DATA stream
+type dataWriter struct {
+	w   *bufio.Writer
+	err error
+
+	lineLen   int
+	lineStart bool
+	sawCR     bool
+}
+
+// NewDataWriter returns a writer for the body of an SMTP DATA command. Bare LF
+// line endings are converted to CRLF, lines starting with a dot are escaped
+// and lines longer than MaximumLineLength fail with ErrLineTooLong. Close
+// writes the terminating ".\r\n" (but does not close w).
+func NewDataWriter(w io.Writer) io.WriteCloser {
+	return &dataWriter{w: bufioWriter(w), lineStart: true}
+}
+
+func (d *dataWriter) Write(p []byte) (n int, err error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	for n < len(p) {
+		c := p[n]
+
+		switch {
+		case c == '\n':
+			if !d.sawCR {
+				d.w.WriteByte('\r')
+			}
+			d.lineLen = 0
+			d.lineStart = true
+			d.sawCR = false
+
+		case c == '\r':
+			d.lineLen++
+			d.lineStart = false
+			d.sawCR = true
+
+		default:
+			if d.lineStart && c == '.' {
+				d.w.WriteByte('.')
+				d.lineLen++
+			}
+			d.lineLen++
+			d.lineStart = false
+			d.sawCR = false
+		}
+
+		// A CR might still turn out to be the end of the line
+		if c != '\r' && d.lineLen > MaximumLineLength {
+			d.err = ErrLineTooLong
+			return n, d.err
+		}
+
+		err = d.w.WriteByte(c)
+		if err != nil {
+			d.err = err
+			return
+		}
+		n++
+	}
+	return
+}
+
+// Close ends the last line (if needed) and writes the terminating dot
+func (d *dataWriter) Close() (err error) {
+	if d.err != nil {
+		return d.err
+	}
+
+	if !d.lineStart {
+		if !d.sawCR {
+			d.w.WriteByte('\r')
+		}
+		d.w.WriteByte('\n')
+	}
+
+	d.w.WriteString(".\r\n")
+
+	d.err = errors.New("Mimestream: write to closed DATA writer")
+	return d.w.Flush()
+}
+
+// bufioWriter ...
+func bufioWriter(w io.Writer) *bufio.Writer {
+	if bufferedWriter, ok := w.(*bufio.Writer); ok {
+		return bufferedWriter
+	}
+	return bufio.NewWriter(w)
+}
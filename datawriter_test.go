@@ -0,0 +1,54 @@
+package mimestream
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDataWriter(t *testing.T) {
+
+	tests := []struct {
+		name string
+		in   []string
+		want string
+		err  error
+	}{
+		{"empty", nil, ".\r\n", nil},
+		{"crlf", []string{"one\r\ntwo\r\n"}, "one\r\ntwo\r\n.\r\n", nil},
+		{"bare lf", []string{"one\ntwo\n"}, "one\r\ntwo\r\n.\r\n", nil},
+		{"unterminated", []string{"one"}, "one\r\n.\r\n", nil},
+		{"dots", []string{".one\r\n..two\n.\r\n"}, "..one\r\n...two\r\n..\r\n.\r\n", nil},
+		{"dot mid line", []string{"a.b\r\n"}, "a.b\r\n.\r\n", nil},
+		{"split writes", []string{"one\r", "\n", ".", "two"}, "one\r\n..two\r\n.\r\n", nil},
+		{"longest line", []string{strings.Repeat("a", 998) + "\r\n"}, strings.Repeat("a", 998) + "\r\n.\r\n", nil},
+		{"line too long", []string{strings.Repeat("a", 999) + "\r\n"}, "", ErrLineTooLong},
+		{"stuffed line too long", []string{"." + strings.Repeat("a", 997) + "\r\n"}, "", ErrLineTooLong},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			w := NewDataWriter(buf)
+
+			var err error
+			for _, s := range test.in {
+				_, err = w.Write([]byte(s))
+				if err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = w.Close()
+			}
+
+			if err != test.err {
+				t.Fatalf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, test.err)
+			}
+
+			if err == nil && buf.String() != test.want {
+				t.Errorf("Invalid output:\n\tGot:%q\n\tWant:%q\n", buf.String(), test.want)
+			}
+		})
+	}
+}
@@ -13,7 +13,8 @@ type File struct {
 	// Name is the basename name of the file
 	Name string
 
-	// Optional, will be detected by File.Name extension
+	// Optional, will be detected by File.Name extension (or from the first
+	// bytes of the Reader with Writer.Sniff)
 	ContentType string
 
 	// Include Inline, or as an Attachment (default)?
@@ -25,12 +26,55 @@ type File struct {
 	// Reader is the data source that the part is populated from.
 	io.Reader
 
-	// Closer is an optional io.Closer that is called after reading the Reader
+	// Closer is an optional io.Closer that is called exactly once when the
+	// part is done, even if it was never written because of an error
 	io.Closer
+
+	// Size is the number of bytes the Reader returns. Optional, only needed
+	// by Parts.Size when the Reader is not an io.Seeker or os.File.
+	Size int64
 }
 
 // Add implements the Source interface.
 func (f File) Add(w *multipart.Writer) (err error) {
+	return f.add(defaultState(), "", w)
+}
+
+func (f File) add(s *writeState, path string, w *multipart.Writer) (err error) {
+
+	// The source is closed whatever happens
+	defer func() {
+		err = appendError(err, s.closed(f.closeSources()))
+	}()
+
+	f, err = f.sniff(s.opts.Sniff)
+	if err != nil {
+		return err
+	}
+
+	var part io.Writer
+	part, err = w.CreatePart(f.header())
+	if err != nil {
+		return err
+	}
+
+	p := s.progress(path)
+
+	// Base64 encode + Mime Wrap to 76 characters
+	base64Encoder := NewMimeBase64Writer(p.writer(part))
+
+	// Copy everything into the base64 encoder
+	// TODO we should be checking bytes written here to prevent partial sends
+	_, err = copyContext(s.ctx, base64Encoder, p.reader(f.Reader))
+	if err != nil {
+		return err
+	}
+
+	// Must close the encoder
+	return base64Encoder.Close()
+}
+
+func (f File) header() textproto.MIMEHeader {
 
 	// Valid Attachment-Headers:
 	//
@@ -73,58 +117,29 @@ func (f File) Add(w *multipart.Writer) (err error) {
 		header["Content-Disposition"] = []string{"Inline"}
 	}
 
-	var part io.Writer
-	part, err = w.CreatePart(header)
-	if err != nil {
-		return err
-	}
-
-	// Base64 encode + Mime Wrap to 76 characters
-	base64Encoder := NewMimeBase64Writer(part)
+	return header
+}
 
-	// Copy everything into the base64 encoder
-	// TODO we should be checking bytes written here to prevent partial sends
-	_, err = io.Copy(base64Encoder, f.Reader)
+func (f File) partSize(s *writeState, path string) (textproto.MIMEHeader, int64, error) {
+	f, err := f.sniffSize(s.opts.Sniff)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 
-	// Must close the encoder
-	base64Encoder.Close()
+	size := f.Size
+	if size == 0 {
+		var ok bool
+		size, ok = readerSize(f.Reader)
+		if !ok {
+			return nil, 0, ErrUnknownSize
+		}
+	}
+	return f.header(), base64Size(size), nil
+}
 
-	// Close the source stream (if needed)
+func (f File) closeSources() error {
 	if f.Closer != nil {
 		return f.Closer.Close()
 	}
-
-	return
+	return nil
 }
-
-// // FormFile is a Source implementation for files read from an io.Reader.
-// type FormFile struct {
-// 	// Name is the name of the file, not to be confused with the name of the
-// 	// Part.
-// 	Name string
-//
-// 	// Reader is the data source that the part is populated from.
-// 	io.Reader
-//
-// 	// Closer is an optional io.Closer that is called after reading the Reader
-// 	io.Closer
-// }
-//
-// // Add implements the Source interface.
-// func (f FormFile) Add(name string, w *multipart.Writer) error {
-// 	part, err := w.CreateFormFile(name, f.Name)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	_, err = io.Copy(part, f.Reader)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	if f.Closer != nil {
-// 		return f.Closer.Close()
-// 	}
-// 	return nil
-// }
@@ -0,0 +1,150 @@
+package mimestream
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+)
+
+// FormField is a multipart/form-data text field
+type FormField struct {
+	Name  string
+	Value string
+}
+
+// Add implements the Source interface.
+func (f FormField) Add(w *multipart.Writer) error {
+	return f.add(defaultState(), "", w)
+}
+
+func (f FormField) add(s *writeState, path string, w *multipart.Writer) error {
+	part, err := w.CreatePart(f.header())
+	if err != nil {
+		return err
+	}
+
+	var n int
+	n, err = io.WriteString(s.progress(path).writer(part), f.Value)
+	if err != nil {
+		return err
+	}
+
+	if n != len(f.Value) {
+		return ErrPartialWrite
+	}
+
+	return nil
+}
+
+func (f FormField) header() textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Disposition": []string{formDataDisposition(f.Name, "")},
+	}
+}
+
+func (f FormField) partSize(s *writeState, path string) (textproto.MIMEHeader, int64, error) {
+	return f.header(), int64(len(f.Value)), nil
+}
+
+// FormFile is a multipart/form-data file upload. Unlike File, the bytes are
+// sent as they are (no base64) like browsers do.
+type FormFile struct {
+	// FieldName is the name of the form field
+	FieldName string
+
+	// Name is the basename of the file, not to be confused with the FieldName
+	Name string
+
+	// Optional, will be detected by FormFile.Name extension (falling back to
+	// application/octet-stream)
+	ContentType string
+
+	// Reader is the data source that the part is populated from.
+	io.Reader
+
+	// Closer is an optional io.Closer that is called exactly once when the
+	// part is done, even if it was never written because of an error
+	io.Closer
+}
+
+// Add implements the Source interface.
+func (f FormFile) Add(w *multipart.Writer) (err error) {
+	return f.add(defaultState(), "", w)
+}
+
+func (f FormFile) add(s *writeState, path string, w *multipart.Writer) (err error) {
+
+	// The source is closed whatever happens
+	defer func() {
+		err = appendError(err, s.closed(f.closeSources()))
+	}()
+
+	var part io.Writer
+	part, err = w.CreatePart(f.header())
+	if err != nil {
+		return err
+	}
+
+	p := s.progress(path)
+	_, err = copyContext(s.ctx, p.writer(part), p.reader(f.Reader))
+	return
+}
+
+func (f FormFile) header() textproto.MIMEHeader {
+	// Base of "" is "."
+	var fName string
+	if f.Name != "" {
+		fName = filepath.Base(f.Name)
+	}
+
+	contentType := f.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(fName))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// Without a name, filename="" like browsers send for an empty file input
+	disposition := formDataDisposition(f.FieldName, fName)
+	if fName == "" {
+		disposition += `; filename=""`
+	}
+
+	return textproto.MIMEHeader{
+		"Content-Disposition": []string{disposition},
+		"Content-Type":        []string{contentType},
+	}
+}
+
+func (f FormFile) partSize(s *writeState, path string) (textproto.MIMEHeader, int64, error) {
+	size, ok := readerSize(f.Reader)
+	if !ok {
+		return nil, 0, ErrUnknownSize
+	}
+	return f.header(), size, nil
+}
+
+func (f FormFile) closeSources() error {
+	if f.Closer != nil {
+		return f.Closer.Close()
+	}
+	return nil
+}
+
+// RFC 7578 forbids the RFC 2231 filename* parameter so, like browsers, names
+// are sent as UTF-8 with only quotes and line breaks percent-encoded.
+// https://html.spec.whatwg.org/multipage/form-control-infrastructure.html#multipart-form-data
+var formDataEscaper = strings.NewReplacer("\"", "%22", "\r", "%0D", "\n", "%0A")
+
+// formDataDisposition for a field with an optional filename
+func formDataDisposition(name, filename string) string {
+	disposition := `form-data; name="` + formDataEscaper.Replace(name) + `"`
+	if filename != "" {
+		disposition += `; filename="` + formDataEscaper.Replace(filename) + `"`
+	}
+	return disposition
+}
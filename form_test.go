@@ -0,0 +1,103 @@
+package mimestream
+
+import (
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestForm(t *testing.T) {
+
+	parts := Parts{
+		FormField{Name: "title", Value: "Holiday \"photos\""},
+		FormFile{
+			FieldName: "upload",
+			Name:      "filename-2 שלום.jpg",
+			Reader:    mockDataSrc(1024 * 1024 * 10),
+		},
+		FormFile{
+			FieldName:   "payload",
+			Name:        "payload",
+			ContentType: "application/json",
+			Reader:      strings.NewReader(`{"one":1,"two":2}`),
+		},
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	go func() {
+		pw.CloseWithError(parts.Into(mw))
+	}()
+
+	req, err := http.NewRequest("POST", "/", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	mr, err := req.MultipartReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if p.Header.Get("Content-Transfer-Encoding") != "" {
+			t.Errorf("Form part should not be encoded: %v", p.Header)
+		}
+
+		// Only the size of the big upload matters
+		value := string(b)
+		if len(b) > 100 {
+			value = strconv.Itoa(len(b))
+		}
+
+		got = append(got, strings.Join([]string{p.FormName(), p.FileName(), p.Header.Get("Content-Type"), value}, "|"))
+	}
+
+	want := []string{
+		"title|||Holiday \"photos\"",
+		"upload|filename-2 שלום.jpg|image/jpeg|10485760",
+		"payload|payload|application/json|{\"one\":1,\"two\":2}",
+	}
+
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Invalid form:\n\tGot:%q\n\tWant:%q\n", got, want)
+	}
+}
+
+func TestFormDataDisposition(t *testing.T) {
+	got := formDataDisposition("a\"b", "line\r\nbreak \"quoted\".txt")
+	want := `form-data; name="a%22b"; filename="line%0D%0Abreak %22quoted%22.txt"`
+	if got != want {
+		t.Errorf("Invalid disposition:\n\tGot:%s\n\tWant:%s\n", got, want)
+	}
+
+	for name, want := range map[string]string{
+		"":                `form-data; name="file"; filename=""`,
+		"/tmp/report.pdf": `form-data; name="file"; filename="report.pdf"`,
+	} {
+		got := FormFile{FieldName: "file", Name: name}.header().Get("Content-Disposition")
+		if got != want {
+			t.Errorf("Invalid disposition for %q:\n\tGot:%s\n\tWant:%s\n", name, got, want)
+		}
+	}
+}
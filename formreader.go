@@ -0,0 +1,185 @@
+package mimestream
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotFormData when the body is not multipart/form-data
+var ErrNotFormData = errors.New("Mimestream: Not a multipart/form-data body")
+
+// ErrFieldNotAllowed for fields missing from FormLimits.Fields
+var ErrFieldNotAllowed = errors.New("Mimestream: Form field not allowed")
+
+// ErrFieldTooLarge is returned when reading more than the field size limit
+var ErrFieldTooLarge = errors.New("Mimestream: Form field too large")
+
+// MaximumFilenameLength in bytes, most file systems do not allow more
+var MaximumFilenameLength = 255
+
+// FormLimits restrict what HandleFormData accepts. The multipart depth and
+// part count limits of the reader apply as well.
+type FormLimits struct {
+	// Fields is the whitelist of field names (all fields are allowed when empty)
+	Fields []string
+
+	// MaxFieldBytes is the size limit of every field (0 for no limit)
+	MaxFieldBytes int64
+
+	// FieldBytes overrides MaxFieldBytes for specific fields
+	FieldBytes map[string]int64
+}
+
+// FormPart is a field or file of a multipart/form-data body
+type FormPart struct {
+	// Name of the form field
+	Name string
+
+	// FileName is sanitized (see SanitizeFilename). It is empty for regular
+	// fields.
+	FileName string
+
+	Header textproto.MIMEHeader
+
+	// Reader of the body, failing with ErrFieldTooLarge past the size limit
+	io.Reader
+}
+
+// HandleFormRequest streams the multipart/form-data body of an HTTP request
+// (see HandleFormData). Wrap r.Body in http.MaxBytesReader to limit the total.
+func HandleFormRequest(r *http.Request, limits FormLimits, h func(p *FormPart) error) error {
+	return HandleFormData(r.Header.Get("Content-Type"), r.Body, limits, h)
+}
+
+// HandleFormData streams every field and file of a multipart/form-data body
+// to the handler without buffering, unlike http.Request.ParseMultipartForm.
+func HandleFormData(contentType string, body io.Reader, limits FormLimits, h func(p *FormPart) error) (err error) {
+	ct, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return
+	}
+	if ct != "multipart/form-data" {
+		return ErrNotFormData
+	}
+
+	allowed := map[string]bool{}
+	for _, name := range limits.Fields {
+		allowed[name] = true
+	}
+
+	header := textproto.MIMEHeader{"Content-Type": []string{contentType}}
+
+	ps := &Parser{}
+	return ps.parseMIMEParts(ps.newParseState(), "", header, body, func(header textproto.MIMEHeader, body io.Reader) (err error) {
+		_, params, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+
+		p := &FormPart{
+			Name:   params["name"],
+			Header: header,
+			Reader: body,
+		}
+
+		if len(allowed) > 0 && !allowed[p.Name] {
+			return errors.Wrap(ErrFieldNotAllowed, p.Name)
+		}
+
+		if _, ok := params["filename"]; ok {
+			p.FileName = SanitizeFilename(params["filename"])
+		}
+
+		max := limits.MaxFieldBytes
+		if n, ok := limits.FieldBytes[p.Name]; ok {
+			max = n
+		}
+		if max > 0 {
+			p.Reader = &fieldLimitReader{r: body, n: max}
+		}
+
+		return h(p)
+	}, 0)
+}
+
+// fieldLimitReader fails with ErrFieldTooLarge once more than n bytes are read
+type fieldLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *fieldLimitReader) Read(p []byte) (n int, err error) {
+	// The error is sticky
+	if l.n < 0 {
+		return 0, ErrFieldTooLarge
+	}
+
+	// Read one byte past the limit to tell a full field from a large one
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err = l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n + int(l.n), ErrFieldTooLarge
+	}
+	return
+}
+
+// SanitizeFilename makes a client provided filename safe to use as a local
+// file name: directories (of any OS) are removed along with control and
+// reserved characters, and the length is limited to MaximumFilenameLength.
+func SanitizeFilename(name string) string {
+	// Old browsers send the full Windows path
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+
+	// Leading dots would hide the file, trailing dots and spaces are dropped
+	// by Windows
+	name = strings.TrimLeft(name, ". ")
+	name = strings.TrimRight(name, ". ")
+
+	if len(name) > MaximumFilenameLength {
+		ext := filepathExt(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		name = truncateUTF8(name[:len(name)-len(ext)], MaximumFilenameLength-len(ext)) + ext
+	}
+
+	if name == "" {
+		return "file"
+	}
+	return name
+}
+
+// filepathExt is filepath.Ext without the OS specific separators
+func filepathExt(name string) string {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		return name[i:]
+	}
+	return ""
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,103 @@
+package mimestream
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestHandleFormData(t *testing.T) {
+
+	parts := func() Parts {
+		return Parts{
+			FormField{Name: "title", Value: "Holiday photos"},
+			FormFile{FieldName: "upload", Name: `C:\Users\john\..photo<1>.jpg`, Reader: mockDataSrc(1024 * 1024)},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		limits FormLimits
+		want   string
+		err    error
+	}{
+		{"no limits", FormLimits{}, "title||14\nupload|photo_1_.jpg|1048576", nil},
+		{"whitelist", FormLimits{Fields: []string{"upload"}}, "", ErrFieldNotAllowed},
+		{"too large", FormLimits{MaxFieldBytes: 1024}, "title||14", ErrFieldTooLarge},
+		{"per field", FormLimits{MaxFieldBytes: 1024, FieldBytes: map[string]int64{"upload": 1024 * 1024}}, "title||14\nupload|photo_1_.jpg|1048576", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body, contentType, _ := NewRequestBody(context.Background(), parts())
+			defer body.Close()
+
+			var got []string
+			err := HandleFormData(contentType, body, test.limits, func(p *FormPart) error {
+				n, err := io.Copy(ioutil.Discard, p)
+				if err != nil {
+					return err
+				}
+				got = append(got, strings.Join([]string{p.Name, p.FileName, strconv.FormatInt(n, 10)}, "|"))
+				return nil
+			})
+
+			if errors.Cause(err) != test.err {
+				t.Fatalf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, test.err)
+			}
+
+			if strings.Join(got, "\n") != test.want {
+				t.Errorf("Invalid fields:\n\tGot:%q\n\tWant:%q\n", strings.Join(got, "\n"), test.want)
+			}
+		})
+	}
+
+	err := HandleFormData("multipart/mixed; boundary=x", strings.NewReader(""), FormLimits{}, nil)
+	if err != ErrNotFormData {
+		t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, ErrNotFormData)
+	}
+}
+
+func TestFieldLimitReader(t *testing.T) {
+	l := &fieldLimitReader{r: strings.NewReader("abcdefgh"), n: 3}
+	p := make([]byte, 16)
+
+	// Reading again after the limit keeps failing without a negative count
+	for i, want := range []int{3, 0, 0} {
+		n, err := l.Read(p)
+		if n != want || err != ErrFieldTooLarge {
+			t.Errorf("Invalid read %d:\n\tGot:%v, %v\n\tWant:%v, %v\n", i, n, err, want, ErrFieldTooLarge)
+		}
+	}
+
+	_, err := ioutil.ReadAll(&fieldLimitReader{r: strings.NewReader("abcdefgh"), n: 3})
+	if err != ErrFieldTooLarge {
+		t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, ErrFieldTooLarge)
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := map[string]string{
+		"photo.jpg":                       "photo.jpg",
+		"../../etc/passwd":                "passwd",
+		`C:\Users\john\photo.jpg`:         "photo.jpg",
+		".htaccess":                       "htaccess",
+		"..":                              "file",
+		"":                                "file",
+		"bad\x00name\r\n.txt":             "bad_name__.txt",
+		"invoice.pdf. ":                   "invoice.pdf",
+		"שלום.txt":                        "שלום.txt",
+		strings.Repeat("é", 200) + ".txt": strings.Repeat("é", 125) + ".txt",
+	}
+
+	for in, want := range tests {
+		if got := SanitizeFilename(in); got != want {
+			t.Errorf("SanitizeFilename(%q):\n\tGot:%q\n\tWant:%q\n", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package mimestream
+
+import (
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HTMLToText converts an HTML document into readable plain text for clients
+// that can't show HTML. Links become numbered footnotes listed at the end,
+// headings are prefixed with #, list items with * (or their number) and table
+// cells are separated by |.
+func HTMLToText(s string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(s))
+	if err != nil {
+		return "", err
+	}
+
+	c := &textConverter{}
+	c.node(doc)
+
+	text := strings.TrimSpace(c.buf.String())
+	if len(c.links) > 0 {
+		text += "\n"
+		for i, link := range c.links {
+			text += "\n[" + strconv.Itoa(i+1) + "] " + link
+		}
+	}
+	return text + "\n", nil
+}
+
+// textConverter writes the text of an HTML tree, collapsing whitespace and
+// keeping track of the blocks, lists and quotes it is in
+type textConverter struct {
+	buf   strings.Builder
+	links []string
+
+	// Line breaks and space waiting for the next text
+	newlines int
+	space    bool
+
+	// Written at the start of every line (quotes and list indents)
+	prefix []string
+
+	// Open lists, numbered from 1 for <ol> and 0 for <ul>
+	lists []int
+
+	// Cells written in the current table row
+	cells int
+
+	pre int
+}
+
+// block ends the current line with at least n line breaks
+func (c *textConverter) block(n int) {
+	if c.newlines < n {
+		c.newlines = n
+	}
+}
+
+// write s, starting a new line first when needed
+func (c *textConverter) write(s string) {
+	if c.buf.Len() == 0 {
+		c.newlines = 0
+		c.space = false
+	}
+
+	if c.newlines > 0 {
+		c.buf.WriteString(strings.Repeat("\n", c.newlines))
+		c.newlines = 0
+		c.space = false
+	}
+
+	if c.atLineStart() {
+		c.buf.WriteString(strings.Join(c.prefix, ""))
+	} else if c.space {
+		c.buf.WriteByte(' ')
+	}
+	c.space = false
+
+	c.buf.WriteString(s)
+}
+
+func (c *textConverter) atLineStart() bool {
+	n := c.buf.Len()
+	return n == 0 || c.buf.String()[n-1] == '\n'
+}
+
+// text of a text node
+func (c *textConverter) text(s string) {
+	if c.pre > 0 {
+		for i, line := range strings.Split(s, "\n") {
+			if i > 0 {
+				c.newlines++
+			}
+			if line != "" {
+				c.write(line)
+			}
+		}
+		return
+	}
+
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		if s != "" {
+			c.space = true
+		}
+		return
+	}
+
+	if strings.IndexAny(s[:1], " \t\r\n\f") == 0 {
+		c.space = true
+	}
+	c.write(strings.Join(words, " "))
+	if strings.IndexAny(s[len(s)-1:], " \t\r\n\f") == 0 {
+		c.space = true
+	}
+}
+
+func (c *textConverter) children(n *html.Node) {
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		c.node(child)
+	}
+}
+
+func (c *textConverter) node(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		c.text(n.Data)
+		return
+	case html.DocumentNode:
+		c.children(n)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Noscript, atom.Template:
+		return
+
+	case atom.Br:
+		c.newlines++
+
+	case atom.Hr:
+		c.block(2)
+		c.write("----")
+		c.block(2)
+
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		c.block(2)
+		c.write(strings.Repeat("#", int(n.Data[1]-'0')))
+		c.space = true
+		c.children(n)
+		c.block(2)
+
+	case atom.P, atom.Table, atom.Dl, atom.Figure, atom.Address:
+		c.block(2)
+		c.children(n)
+		c.block(2)
+
+	case atom.Pre:
+		c.block(2)
+		c.pre++
+		c.children(n)
+		c.pre--
+		c.block(2)
+
+	case atom.Blockquote:
+		c.block(2)
+		c.prefix = append(c.prefix, "> ")
+		c.children(n)
+		c.prefix = c.prefix[:len(c.prefix)-1]
+		c.block(2)
+
+	case atom.Ul, atom.Ol:
+		if len(c.lists) == 0 {
+			c.block(2)
+		} else {
+			c.block(1)
+		}
+		number := 0
+		if n.DataAtom == atom.Ol {
+			number = 1
+		}
+		c.lists = append(c.lists, number)
+		c.children(n)
+		c.lists = c.lists[:len(c.lists)-1]
+		if len(c.lists) == 0 {
+			c.block(2)
+		} else {
+			c.block(1)
+		}
+
+	case atom.Li:
+		c.block(1)
+		c.listItem(n)
+		c.block(1)
+
+	case atom.Tr:
+		c.block(1)
+		cells := c.cells
+		c.cells = 0
+		c.children(n)
+		c.cells = cells
+		c.block(1)
+
+	case atom.Td, atom.Th:
+		if c.cells > 0 {
+			c.space = false
+			c.write(" |")
+			c.space = true
+		}
+		c.cells++
+		c.children(n)
+
+	case atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer,
+		atom.Nav, atom.Aside, atom.Main, atom.Form, atom.Dt, atom.Dd,
+		atom.Caption, atom.Figcaption, atom.Center:
+		c.block(1)
+		c.children(n)
+		c.block(1)
+
+	case atom.A:
+		c.link(n)
+
+	case atom.Img:
+		if alt := attr(n, "alt"); strings.TrimSpace(alt) != "" {
+			c.write("[" + strings.Join(strings.Fields(alt), " ") + "]")
+		}
+
+	default:
+		c.children(n)
+	}
+}
+
+// listItem writes the bullet or number of the item, then indents the lines
+// that follow (and any nested list) to line up with its text
+func (c *textConverter) listItem(n *html.Node) {
+	depth := len(c.lists)
+	if depth == 0 {
+		c.children(n)
+		return
+	}
+
+	marker := "*"
+	if number := c.lists[depth-1]; number > 0 {
+		marker = strconv.Itoa(number) + "."
+		c.lists[depth-1]++
+	}
+	marker += " "
+
+	c.write(marker)
+	c.prefix = append(c.prefix, strings.Repeat(" ", len(marker)))
+	c.children(n)
+	c.prefix = c.prefix[:len(c.prefix)-1]
+}
+
+// link writes the text of the link followed by its footnote number. Links to
+// the page itself, scripts and links showing their own URL get no footnote.
+func (c *textConverter) link(n *html.Node) {
+	start := c.buf.Len()
+	c.children(n)
+	text := strings.TrimSpace(c.buf.String()[start:])
+
+	href := strings.TrimSpace(attr(n, "href"))
+	if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(strings.ToLower(href), "javascript:") {
+		return
+	}
+
+	if text == "" {
+		c.write(href)
+		return
+	}
+	if text == href || "mailto:"+text == href {
+		return
+	}
+
+	for i, link := range c.links {
+		if link == href {
+			c.buf.WriteString("[" + strconv.Itoa(i+1) + "]")
+			return
+		}
+	}
+
+	c.links = append(c.links, href)
+	c.buf.WriteString("[" + strconv.Itoa(len(c.links)) + "]")
+}
+
+// attr value of the element (empty if missing)
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,69 @@
+package mimestream
+
+import (
+	"bytes"
+	"mime/multipart"
+	"strings"
+	"testing"
+)
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{"paragraphs", "<p>One  two\n three</p><p>Four<br>Five</p>", "One two three\n\nFour\nFive\n"},
+		{"headings", "<h1>Title</h1><h2>Sub <i>title</i></h2><p>Body</p>", "# Title\n\n## Sub title\n\nBody\n"},
+		{"links", `<p>See <a href="https://example.com/a">the docs</a> and <a href="https://example.com/b">this</a> or <a href="https://example.com/a">again</a>.</p>`,
+			"See the docs[1] and this[2] or again[1].\n\n[1] https://example.com/a\n[2] https://example.com/b\n"},
+		{"plain links", `<a href="https://example.com">https://example.com</a> <a href="mailto:a@example.com">a@example.com</a> <a href="#top">Top</a>`,
+			"https://example.com a@example.com Top\n"},
+		{"lists", "<ul><li>One</li><li>Two<ol><li>A</li><li>B</li></ol></li></ul>", "* One\n* Two\n  1. A\n  2. B\n"},
+		{"table", "<table><tr><th>Name</th><th>Qty</th></tr><tr><td>Apple</td><td>3</td></tr></table>", "Name | Qty\nApple | 3\n"},
+		{"quote", "<p>Said:</p><blockquote>Hello<br>there</blockquote>", "Said:\n\n> Hello\n> there\n"},
+		{"skipped", "<html><head><title>T</title><style>p{}</style></head><body><script>x()</script><p>Shown &amp; <img alt=\"logo\"></p></body></html>", "Shown & [logo]\n"},
+		{"pre", "<pre>a  b\n  c</pre>", "a  b\n  c\n"},
+	}
+
+	for _, test := range tests {
+		got, err := HTMLToText(test.html)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("Invalid %s text:\n\tGot:%q\n\tWant:%q\n", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAlternativePlainText(t *testing.T) {
+	alternative := Alternative{Parts: Parts{
+		Text{ContentType: TextHTML, Text: `<p>Hello <a href="https://example.com">world</a></p>`},
+	}}
+
+	for _, wr := range []*Writer{{}, {NoPlainText: true}} {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+
+		err := wr.Into(mw, Parts{alternative})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		size, err := wr.Size(Parts{alternative})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Size uses its own boundaries of the same length
+		if size != int64(buf.Len()) {
+			t.Errorf("Invalid size:\n\tGot:%v\n\tWant:%v\n", size, buf.Len())
+		}
+
+		hasText := strings.Contains(buf.String(), "Hello world[1]\r\n\r\n[1] https://example.com")
+		if hasText == wr.NoPlainText {
+			t.Errorf("Invalid plain text part:\n\tGot:%v\n\tWant:%v\n", hasText, !wr.NoPlainText)
+		}
+	}
+}
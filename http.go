@@ -0,0 +1,58 @@
+package mimestream
+
+import (
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+)
+
+// NewRequestBody streams the Parts as a multipart/form-data body. The parts are
+// written in a goroutine as the body is read; a write error is returned from
+// Read and cancelling ctx (or closing the body) stops the writer.
+// contentLength is -1 unless the size of every part is known in advance.
+func NewRequestBody(ctx context.Context, parts Parts) (body io.ReadCloser, contentType string, contentLength int64) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	contentLength, err := parts.Size(mw.Boundary())
+	if err != nil {
+		contentLength = -1
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			pw.CloseWithError(ctx.Err())
+		case <-done:
+		}
+	}()
+
+	go func() {
+		defer close(done)
+		pw.CloseWithError(parts.IntoContext(ctx, mw))
+	}()
+
+	return pr, mw.FormDataContentType(), contentLength
+}
+
+// NewUploadRequest returns a request with the Parts as a streaming
+// multipart/form-data body (see NewRequestBody)
+func NewUploadRequest(ctx context.Context, method, url string, parts Parts) (req *http.Request, err error) {
+	body, contentType, contentLength := NewRequestBody(ctx, parts)
+
+	req, err = http.NewRequest(method, url, body)
+	if err != nil {
+		body.Close()
+		return
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	if contentLength >= 0 {
+		req.ContentLength = contentLength
+	}
+	return
+}
@@ -0,0 +1,144 @@
+package mimestream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadRequest(t *testing.T) {
+
+	type upload struct {
+		contentLength int64
+		received      int64
+		files         int
+	}
+	uploads := make(chan upload, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := upload{contentLength: r.ContentLength}
+
+		mr, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if p.FileName() != "" {
+				u.files++
+			}
+			io.Copy(ioutil.Discard, p)
+		}
+
+		// Whatever the multipart reader did not need (the epilogue)
+		io.Copy(ioutil.Discard, r.Body)
+		uploads <- u
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name  string
+		parts Parts
+		known bool
+	}{
+		{
+			"known size",
+			Parts{
+				FormField{Name: "title", Value: "Holiday photos"},
+				FormFile{FieldName: "one", Name: "one.jpg", Reader: bytes.NewReader(make([]byte, 1024*1024))},
+				FormFile{FieldName: "two", Name: "שלום.txt", Reader: strings.NewReader("two")},
+			},
+			true,
+		},
+		{
+			"unknown size",
+			Parts{
+				FormField{Name: "title", Value: "Holiday photos"},
+				FormFile{FieldName: "one", Name: "one.jpg", Reader: mockDataSrc(1024 * 1024)},
+			},
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			// Count what is actually sent
+			body, contentType, contentLength := NewRequestBody(context.Background(), test.parts)
+			n, err := io.Copy(ioutil.Discard, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !strings.HasPrefix(contentType, "multipart/form-data; boundary=") {
+				t.Errorf("Invalid Content-Type: %s", contentType)
+			}
+
+			if test.known && contentLength != n {
+				t.Errorf("Invalid Content-Length:\n\tGot:%d\n\tWant:%d\n", contentLength, n)
+			}
+			if !test.known && contentLength != -1 {
+				t.Errorf("Invalid Content-Length:\n\tGot:%d\n\tWant:%d\n", contentLength, -1)
+			}
+		})
+	}
+
+	// The sources above were consumed, so start over
+	req, err := NewUploadRequest(context.Background(), "POST", server.URL, Parts{
+		FormField{Name: "title", Value: "Holiday photos"},
+		FormFile{FieldName: "one", Name: "one.jpg", Reader: bytes.NewReader(make([]byte, 1024*1024))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Invalid status: %s", res.Status)
+	}
+
+	u := <-uploads
+	if u.contentLength != req.ContentLength || u.files != 1 {
+		t.Errorf("Invalid upload: %+v (sent Content-Length %d)", u, req.ContentLength)
+	}
+}
+
+func TestRequestBodyCancel(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	body, _, _ := NewRequestBody(ctx, Parts{
+		FormFile{
+			FieldName: "slow",
+			Name:      "slow.bin",
+			Reader:    &SlowReader{Reader: mockDataSrc(1024 * 1024 * 100), Speed: time.Millisecond},
+		},
+	})
+
+	time.AfterFunc(time.Millisecond*50, cancel)
+
+	_, err := io.Copy(ioutil.Discard, body)
+	if err != context.Canceled {
+		t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, context.Canceled)
+	}
+}
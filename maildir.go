@@ -0,0 +1,192 @@
+package mimestream
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Maildir is the path of a Maildir with cur, new and tmp sub directories
+type Maildir string
+
+// Standard flags of the ":2," info suffix, in the order they must be listed
+const (
+	FlagDraft   = 'D'
+	FlagFlagged = 'F'
+	FlagPassed  = 'P'
+	FlagReplied = 'R'
+	FlagSeen    = 'S'
+	FlagTrashed = 'T'
+)
+
+// MaildirFlags are the flags of a message, for example "FS"
+type MaildirFlags string
+
+// Has reports if the flag is set
+func (f MaildirFlags) Has(flag rune) bool {
+	return strings.ContainsRune(string(f), flag)
+}
+
+// MaildirMessage is a message found in cur or new
+type MaildirMessage struct {
+	// Key is the unique name without the info suffix
+	Key  string
+	Path string
+
+	// New messages have not been seen by a mail reader yet
+	New bool
+
+	Flags MaildirFlags
+}
+
+// Open the message file
+func (m MaildirMessage) Open() (*os.File, error) {
+	return os.Open(m.Path)
+}
+
+// Guarantees unique names for deliveries within the same microsecond
+var maildirCounter uint64
+
+// Create the Maildir directories (if they do not exist yet)
+func (d Maildir) Create() error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(string(d), sub), 0700)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deliver whatever write produces (for example Message.Into). The message is
+// written to tmp and only moved to new once it is complete and synced, so
+// readers never see a partial message. Returns the key of the new message.
+func (d Maildir) Deliver(write func(w io.Writer) error) (key string, err error) {
+	key, err = maildirKey()
+	if err != nil {
+		return
+	}
+
+	tmp := filepath.Join(string(d), "tmp", key)
+
+	var f *os.File
+	f, err = os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	bw := bufio.NewWriter(f)
+	err = write(bw)
+	if err != nil {
+		return
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return
+	}
+
+	err = f.Close()
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(tmp, filepath.Join(string(d), "new", key))
+	return
+}
+
+// maildirKey builds a unique name as described in https://cr.yp.to/proto/maildir.html
+func maildirKey() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	hostname = strings.Replace(hostname, "/", `\057`, -1)
+	hostname = strings.Replace(hostname, ":", `\072`, -1)
+
+	now := time.Now()
+	n := atomic.AddUint64(&maildirCounter, 1)
+
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), n, hostname), nil
+}
+
+// Walk calls fn for every message in new and then cur. Directories are read
+// in batches so huge Maildirs are not listed in memory.
+func (d Maildir) Walk(fn func(m MaildirMessage) error) error {
+	for _, sub := range []string{"new", "cur"} {
+		dir, err := os.Open(filepath.Join(string(d), sub))
+		if err != nil {
+			return err
+		}
+
+		for {
+			var names []string
+			names, err = dir.Readdirnames(100)
+			if err != nil {
+				break
+			}
+
+			for _, name := range names {
+				if strings.HasPrefix(name, ".") {
+					continue
+				}
+
+				m := MaildirMessage{
+					Key:  name,
+					Path: filepath.Join(string(d), sub, name),
+					New:  sub == "new",
+				}
+
+				if i := strings.Index(name, ":"); i >= 0 {
+					m.Key = name[:i]
+					if strings.HasPrefix(name[i:], ":2,") {
+						m.Flags = MaildirFlags(name[i+3:])
+					}
+				}
+
+				err = fn(m)
+				if err != nil {
+					dir.Close()
+					return err
+				}
+			}
+		}
+
+		dir.Close()
+		if err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleMaildir passes every message in the Maildir to HandleEmailFromReader.
+// h is called with each message and returns the handler for its parts.
+func HandleMaildir(d Maildir, h func(m MaildirMessage) partHandler) error {
+	return d.Walk(func(m MaildirMessage) error {
+		f, err := m.Open()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return HandleEmailFromReader(f, h(m))
+	})
+}
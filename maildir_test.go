@@ -0,0 +1,105 @@
+package mimestream
+
+import (
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestMaildir(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "mimestream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := Maildir(dir)
+	err = d.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for _, text := range []string{"one", "two"} {
+		m := Message{Parts: Parts{Text{Text: text}}}
+		var key string
+		key, err = d.Deliver(m.Into)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+
+	// A plain message without MIME headers
+	key, err := d.Deliver(func(w io.Writer) error {
+		_, err := io.WriteString(w, "From: john@example.com\r\nSubject: plain\r\n\r\nthree")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys = append(keys, key)
+
+	if keys[0] == keys[1] {
+		t.Errorf("Keys are not unique: %q", keys)
+	}
+
+	// A mail reader has seen the second message
+	err = os.Rename(filepath.Join(dir, "new", keys[1]), filepath.Join(dir, "cur", keys[1]+":2,RS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed delivery leaves nothing behind
+	_, err = d.Deliver(func(w io.Writer) error {
+		io.WriteString(w, "Subject: partial\r\n")
+		return errors.New("source failed")
+	})
+	if err == nil {
+		t.Error("Failed delivery did not return an error")
+	}
+
+	tmp, _ := ioutil.ReadDir(filepath.Join(dir, "tmp"))
+	if len(tmp) != 0 {
+		t.Errorf("Failed delivery left %d files in tmp", len(tmp))
+	}
+
+	var found []string
+	err = HandleMaildir(d, func(m MaildirMessage) partHandler {
+		return func(header textproto.MIMEHeader, body io.Reader) error {
+			b, err := ioutil.ReadAll(body)
+			sub := "cur"
+			if m.New {
+				sub = "new"
+			}
+			found = append(found, strings.Join([]string{m.Key, string(b), string(m.Flags), sub}, "|"))
+			if m.Flags.Has(FlagSeen) != (m.Key == keys[1]) {
+				t.Errorf("Invalid flags %q for %s", m.Flags, m.Key)
+			}
+			return err
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		keys[0] + "|one||new",
+		keys[1] + "|two|RS|cur",
+		keys[2] + "|three||new",
+	}
+	sort.Strings(found)
+	sort.Strings(want)
+
+	if strings.Join(found, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Invalid messages:\n\tGot:%q\n\tWant:%q\n", found, want)
+	}
+}
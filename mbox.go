@@ -0,0 +1,487 @@
+package mimestream
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MboxFormat is the convention an mbox file uses to keep "From " lines in a
+// message body from being mistaken for the start of the next message
+type MboxFormat int
+
+const (
+	// Mboxo quotes "From " lines as ">From ". Unquoting is ambiguous, a
+	// ">From " line that was in the original message loses its ">".
+	Mboxo MboxFormat = iota
+
+	// Mboxrd quotes ">*From " lines with one more ">" so quoting is reversible
+	Mboxrd
+
+	// Mboxcl2 does not quote, the body length is given by Content-Length
+	Mboxcl2
+)
+
+// ErrInvalidMbox when the data does not start with a From_ line
+var ErrInvalidMbox = errors.New("Mimestream: Invalid mbox, missing From_ line")
+
+// The line starting each message
+var mboxSeparator = []byte("From ")
+
+// MboxReader iterates the messages of an mbox file as streams
+type MboxReader struct {
+	r      *bufio.Reader
+	format MboxFormat
+
+	// The From_ line of the next message (once read)
+	next    []byte
+	current *mboxMessage
+}
+
+// NewMboxReader reads messages stored in the given format from r
+func NewMboxReader(r io.Reader, format MboxFormat) *MboxReader {
+	return &MboxReader{r: bufioReader(r), format: format}
+}
+
+// Next returns the From_ line (without the "From " prefix) and the next
+// message. The message is only valid until the following call to Next.
+// io.EOF is returned after the last message.
+func (m *MboxReader) Next() (from string, msg io.Reader, err error) {
+
+	// Skip whatever is left of the previous message
+	if m.current != nil {
+		_, err = io.Copy(ioutil.Discard, m.current)
+		if err != nil {
+			return
+		}
+		m.current = nil
+	}
+
+	if m.next == nil {
+		// Only blank lines may come before the first message
+		for {
+			m.next, err = readMboxLine(m.r)
+			if len(m.next) == 0 && err != nil {
+				return
+			}
+			if len(bytes.TrimSpace(m.next)) != 0 || err != nil {
+				break
+			}
+		}
+		if !bytes.HasPrefix(m.next, mboxSeparator) {
+			return "", nil, ErrInvalidMbox
+		}
+	}
+
+	from = strings.TrimSpace(string(m.next[len(mboxSeparator):]))
+	m.next = nil
+
+	m.current = &mboxMessage{m: m, body: -1, atLineStart: true}
+	if m.format == Mboxcl2 {
+		err = m.current.readHeader()
+		if err != nil {
+			return
+		}
+	}
+
+	return from, m.current, nil
+}
+
+// HandleMboxFromReader passes every message in the mbox to
+// HandleEmailFromReader. h is called with the From_ line of each message and
+// returns the handler for its parts.
+func HandleMboxFromReader(r io.Reader, format MboxFormat, h func(from string) partHandler) (err error) {
+	mr := NewMboxReader(r, format)
+	for {
+		var from string
+		var msg io.Reader
+		from, msg, err = mr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return
+		}
+
+		err = HandleEmailFromReader(msg, h(from))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// mboxMessage reads a single message, stopping at the next From_ line
+type mboxMessage struct {
+	m   *MboxReader
+	buf []byte
+
+	// A blank line is only part of the message if no From_ line follows
+	blank []byte
+
+	// Bytes left of a Content-Length body (mboxcl2), -1 when not known
+	body int64
+
+	atLineStart bool
+	done        bool
+}
+
+func (msg *mboxMessage) Read(p []byte) (n int, err error) {
+	for len(msg.buf) == 0 {
+		if msg.done {
+			return 0, io.EOF
+		}
+		err = msg.fill()
+		if err != nil {
+			return
+		}
+	}
+
+	n = copy(p, msg.buf)
+	msg.buf = msg.buf[n:]
+	return
+}
+
+// readHeader reads the header block of an mboxcl2 message to find the length
+// of the body
+func (msg *mboxMessage) readHeader() error {
+	msg.body = -1
+	for {
+		line, err := readMboxLine(msg.m.r)
+		msg.buf = append(msg.buf, line...)
+		if err == io.EOF {
+			msg.done = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			msg.atLineStart = true
+			return nil
+		}
+
+		kv := bytes.SplitN(line, []byte(":"), 2)
+		if len(kv) == 2 && strings.EqualFold(string(bytes.TrimSpace(kv[0])), "Content-Length") {
+			msg.body, _ = strconv.ParseInt(string(bytes.TrimSpace(kv[1])), 10, 64)
+		}
+	}
+}
+
+func (msg *mboxMessage) fill() (err error) {
+	r := msg.m.r
+
+	// mboxcl2 bodies are copied as they are
+	if msg.body > 0 {
+		if cap(msg.buf) < 32*1024 {
+			msg.buf = make([]byte, 32*1024)
+		}
+		msg.buf = msg.buf[:cap(msg.buf)]
+		if int64(len(msg.buf)) > msg.body {
+			msg.buf = msg.buf[:msg.body]
+		}
+		var n int
+		n, err = io.ReadFull(r, msg.buf)
+		msg.buf = msg.buf[:n]
+		msg.body -= int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
+	// Past the end of a mboxcl2 body only blank lines come before the next
+	// From_ line
+	skip := msg.body == 0
+
+	var line []byte
+	line, err = r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		err = nil
+	}
+	if err == io.EOF {
+		msg.done = true
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+
+	// Not the start of a line, so nothing to check
+	if !msg.atLineStart {
+		msg.buf = append(msg.buf[:0], line...)
+		msg.atLineStart = bytes.HasSuffix(line, []byte("\n"))
+		return
+	}
+
+	if bytes.HasPrefix(line, mboxSeparator) && !msg.done {
+		msg.m.next = append([]byte{}, line...)
+		msg.done = true
+		return
+	}
+
+	// The blank line before the end of the file is not part of the message
+	if skip || len(line) == 0 {
+		return
+	}
+
+	msg.buf = msg.buf[:0]
+	if msg.blank != nil {
+		msg.buf = append(msg.buf, msg.blank...)
+		msg.blank = nil
+	}
+
+	if len(bytes.TrimRight(line, "\r\n")) == 0 && len(line) != 0 {
+		msg.blank = append([]byte{}, line...)
+		return
+	}
+
+	if msg.body < 0 {
+		line = unquoteMboxLine(line, msg.m.format)
+	}
+
+	msg.buf = append(msg.buf, line...)
+	msg.atLineStart = bytes.HasSuffix(line, []byte("\n"))
+	return
+}
+
+// unquoteMboxLine removes the ">" the writer added
+func unquoteMboxLine(line []byte, format MboxFormat) []byte {
+	switch format {
+	case Mboxo:
+		if bytes.HasPrefix(line, []byte(">From ")) {
+			return line[1:]
+		}
+	case Mboxrd:
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), mboxSeparator) && line[0] == '>' {
+			return line[1:]
+		}
+	}
+	return line
+}
+
+// readMboxLine reads a complete line
+func readMboxLine(r *bufio.Reader) (line []byte, err error) {
+	line, err = r.ReadBytes('\n')
+	return
+}
+
+// MboxWriter appends messages to an mbox file
+type MboxWriter struct {
+	w      *bufio.Writer
+	format MboxFormat
+}
+
+// NewMboxWriter writes messages to w in the given format
+func NewMboxWriter(w io.Writer, format MboxFormat) *MboxWriter {
+	return &MboxWriter{w: bufioWriter(w), format: format}
+}
+
+// WriteMessage appends whatever write produces (for example Message.Into) as
+// a single message. from is the envelope sender (defaults to MAILER-DAEMON)
+// and date the delivery time. Line endings are converted to LF.
+func (m *MboxWriter) WriteMessage(from string, date time.Time, write func(w io.Writer) error) (err error) {
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+
+	if m.format == Mboxcl2 {
+		return m.writeCounted(from, date, write)
+	}
+
+	_, err = fmt.Fprintf(m.w, "From %s %s\n", from, date.UTC().Format(time.ANSIC))
+	if err != nil {
+		return
+	}
+
+	qw := &mboxQuoter{w: m.w, format: m.format, atLineStart: true}
+	err = write(qw)
+	if err != nil {
+		return
+	}
+
+	err = qw.Close()
+	if err != nil {
+		return
+	}
+
+	return m.w.Flush()
+}
+
+// writeCounted spools the message to a temporary file to find the length of
+// the body for the Content-Length header
+func (m *MboxWriter) writeCounted(from string, date time.Time, write func(w io.Writer) error) (err error) {
+	var tmp *os.File
+	tmp, err = ioutil.TempFile("", "mimestream-mbox")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	qw := &mboxQuoter{w: tmp, format: m.format, atLineStart: true}
+	err = write(qw)
+	if err != nil {
+		return
+	}
+	err = qw.Close()
+	if err != nil {
+		return
+	}
+
+	var size int64
+	size, err = tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+
+	_, err = fmt.Fprintf(m.w, "From %s %s\n", from, date.UTC().Format(time.ANSIC))
+	if err != nil {
+		return
+	}
+
+	// Copy the header, replacing any Content-Length
+	r := bufio.NewReader(tmp)
+	var line []byte
+	for {
+		line, err = readMboxLine(r)
+		size -= int64(len(line))
+		if err != nil && err != io.EOF {
+			return
+		}
+
+		if len(bytes.TrimRight(line, "\n")) == 0 {
+			break
+		}
+
+		kv := bytes.SplitN(line, []byte(":"), 2)
+		if !strings.EqualFold(string(bytes.TrimSpace(kv[0])), "Content-Length") {
+			m.w.Write(line)
+		}
+
+		if err == io.EOF {
+			size = 0
+			break
+		}
+	}
+
+	// Without the blank line the body is empty
+	if size < 0 {
+		size = 0
+	}
+
+	fmt.Fprintf(m.w, "Content-Length: %d\n\n", size)
+
+	_, err = io.Copy(m.w, r)
+	if err != nil {
+		return
+	}
+
+	// The message always ends with a newline (see mboxQuoter.Close)
+	_, err = m.w.WriteString("\n")
+	if err != nil {
+		return
+	}
+
+	return m.w.Flush()
+}
+
+// mboxQuoter converts CRLF to LF and quotes "From " lines while streaming. The
+// start of each line is held back until we know if it needs quoting.
+type mboxQuoter struct {
+	w      io.Writer
+	format MboxFormat
+
+	pending     []byte
+	atLineStart bool
+	sawCR       bool
+}
+
+func (q *mboxQuoter) Write(p []byte) (n int, err error) {
+	out := make([]byte, 0, len(p)+8)
+
+	for _, c := range p {
+		if q.sawCR {
+			q.sawCR = false
+			if c != '\n' {
+				out = q.add(out, '\r')
+			}
+		}
+		if c == '\r' {
+			q.sawCR = true
+			continue
+		}
+		out = q.add(out, c)
+	}
+
+	_, err = q.w.Write(out)
+	if err != nil {
+		return
+	}
+	return len(p), nil
+}
+
+// add appends c to out, holding back the start of a line
+func (q *mboxQuoter) add(out []byte, c byte) []byte {
+	if !q.atLineStart {
+		q.atLineStart = c == '\n'
+		return append(out, c)
+	}
+
+	q.pending = append(q.pending, c)
+
+	rest := bytes.TrimLeft(q.pending, ">")
+	if c != '\n' && len(rest) < len(mboxSeparator) && bytes.HasPrefix(mboxSeparator, rest) {
+		return out
+	}
+
+	return q.release(out)
+}
+
+// release writes the held back start of a line, quoting it if needed
+func (q *mboxQuoter) release(out []byte) []byte {
+	rest := bytes.TrimLeft(q.pending, ">")
+	quoted := len(rest) != len(q.pending)
+
+	if bytes.HasPrefix(rest, mboxSeparator) && (q.format == Mboxrd || (q.format == Mboxo && !quoted)) {
+		out = append(out, '>')
+	}
+
+	out = append(out, q.pending...)
+	q.atLineStart = q.pending[len(q.pending)-1] == '\n'
+	q.pending = q.pending[:0]
+	return out
+}
+
+// Close ends the message with a newline followed by the blank line that
+// separates messages
+func (q *mboxQuoter) Close() (err error) {
+	var out []byte
+	if q.sawCR {
+		out = append(out, '\r')
+	}
+	if len(q.pending) > 0 {
+		out = q.release(out)
+	}
+	if !q.atLineStart {
+		out = append(out, '\n')
+	}
+	if q.format != Mboxcl2 {
+		out = append(out, '\n')
+	}
+
+	_, err = q.w.Write(out)
+	return
+}
@@ -0,0 +1,146 @@
+package mimestream
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMboxRoundTrip(t *testing.T) {
+
+	text := "From the start\n>From quoted\n>>From twice\n\nFrom after a blank line\n"
+
+	tests := []struct {
+		format MboxFormat
+		want   string
+	}{
+		{Mboxo, "From the start\nFrom quoted\n>>From twice\n\nFrom after a blank line\n"},
+		{Mboxrd, text},
+		{Mboxcl2, text},
+	}
+
+	for _, test := range tests {
+		buf := &bytes.Buffer{}
+		mw := NewMboxWriter(buf, test.format)
+
+		date := time.Date(2002, 1, 10, 11, 12, 0, 0, time.UTC)
+		for _, sender := range []string{"john@example.com", ""} {
+			m := Message{
+				Header: textproto.MIMEHeader{"Subject": []string{"mbox"}},
+				Parts: Parts{
+					Text{Text: text},
+					File{Name: "payload.json", Reader: strings.NewReader(`{"one":1,"two":2}`)},
+				},
+			}
+			err := mw.WriteMessage(sender, date, m.Into)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if !strings.HasPrefix(buf.String(), "From john@example.com Thu Jan 10 11:12:00 2002\n") {
+			t.Errorf("Invalid From_ line: %q", strings.SplitN(buf.String(), "\n", 2)[0])
+		}
+
+		var senders []string
+		var bodies []string
+		err := HandleMboxFromReader(bytes.NewReader(buf.Bytes()), test.format, func(from string) partHandler {
+			senders = append(senders, strings.Fields(from)[0])
+			return func(header textproto.MIMEHeader, body io.Reader) error {
+				b, err := ioutil.ReadAll(body)
+				bodies = append(bodies, string(b))
+				return err
+			}
+		})
+		if err != nil {
+			t.Fatalf("format %d: %v\n%s", test.format, err, buf.String())
+		}
+
+		if strings.Join(senders, ",") != "john@example.com,MAILER-DAEMON" {
+			t.Errorf("format %d: Invalid senders: %q", test.format, senders)
+		}
+
+		if len(bodies) != 4 {
+			t.Fatalf("format %d: Invalid number of parts found:\n\tGot:%d\n\tWant:%d\n", test.format, len(bodies), 4)
+		}
+
+		for i, want := range []string{test.want, `{"one":1,"two":2}`, test.want, `{"one":1,"two":2}`} {
+			if bodies[i] != want {
+				t.Errorf("format %d: Invalid body %d:\n\tGot:%q\n\tWant:%q\n", test.format, i, bodies[i], want)
+			}
+		}
+	}
+}
+
+func TestMboxReader(t *testing.T) {
+
+	mbox := strings.Join([]string{
+		"",
+		"From john@example.com Thu Jan 10 11:12:00 2002",
+		"Subject: one",
+		"",
+		">From the body",
+		"",
+		"",
+		"From jane@example.com Thu Jan 10 11:13:00 2002",
+		"Subject: two",
+		"",
+		"last line",
+		"",
+	}, "\n")
+
+	mr := NewMboxReader(strings.NewReader(mbox), Mboxrd)
+
+	var messages []string
+	for {
+		from, msg, err := mr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := ioutil.ReadAll(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, from+"|"+string(b))
+	}
+
+	want := []string{
+		"john@example.com Thu Jan 10 11:12:00 2002|Subject: one\n\nFrom the body\n\n",
+		"jane@example.com Thu Jan 10 11:13:00 2002|Subject: two\n\nlast line\n",
+	}
+
+	if strings.Join(messages, "\n--\n") != strings.Join(want, "\n--\n") {
+		t.Errorf("Invalid messages:\n\tGot:%q\n\tWant:%q\n", messages, want)
+	}
+
+	// Plain messages without MIME headers are text/plain bodies
+	var bodies []string
+	err := HandleMboxFromReader(strings.NewReader(mbox), Mboxrd, func(from string) partHandler {
+		return func(header textproto.MIMEHeader, body io.Reader) error {
+			b, err := ioutil.ReadAll(body)
+			bodies = append(bodies, string(b))
+			return err
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantBodies := []string{"From the body\n\n", "last line\n"}
+	if strings.Join(bodies, "|") != strings.Join(wantBodies, "|") {
+		t.Errorf("Invalid bodies:\n\tGot:%q\n\tWant:%q\n", bodies, wantBodies)
+	}
+
+	_, _, err = NewMboxReader(strings.NewReader("Subject: no From_ line\n"), Mboxo).Next()
+	if err != ErrInvalidMbox {
+		t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, ErrInvalidMbox)
+	}
+}
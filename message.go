@@ -0,0 +1,162 @@
+package mimestream
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Message is an RFC 5322 email: the top level headers followed by the Parts
+// as a multipart/mixed body.
+type Message struct {
+	// Header values must already be encoded (see mime.QEncoding). The
+	// Mime-Version and Content-Type headers are set when writing.
+	Header textproto.MIMEHeader
+
+	// The address headers (optional), encoded and folded when writing. They
+	// replace the same headers in Header.
+	From    AddressList
+	ReplyTo AddressList
+	To      AddressList
+	Cc      AddressList
+
+	Parts Parts
+}
+
+// Into writes the complete message to w
+func (m Message) Into(w io.Writer) (err error) {
+	return (&Writer{}).WriteMessage(w, m)
+}
+
+// IntoContext is Into stopping as soon as ctx is done (see
+// Writer.WriteMessageContext)
+func (m Message) IntoContext(ctx context.Context, w io.Writer) (err error) {
+	return (&Writer{}).WriteMessageContext(ctx, w, m)
+}
+
+// Size is the exact number of bytes Into writes (see Parts.Size)
+func (m Message) Size() (size int64, err error) {
+	return (&Writer{}).MessageSize(m)
+}
+
+// header of the message. Address lists with control characters are an
+// ErrAddressSyntax.
+func (m Message) header(boundary string) (header textproto.MIMEHeader, err error) {
+	header = textproto.MIMEHeader{}
+	for k, v := range m.Header {
+		header[k] = v
+	}
+	for key, list := range map[string]AddressList{"From": m.From, "Reply-To": m.ReplyTo, "To": m.To, "Cc": m.Cc} {
+		if len(list) == 0 {
+			continue
+		}
+		err = list.Check()
+		if err != nil {
+			return nil, errors.Wrap(err, key)
+		}
+		SetAddressHeader(header, key, list)
+	}
+
+	header.Set("Mime-Version", "1.0")
+	header.Set("Content-Type", fmt.Sprintf("%s; boundary=%s", MultipartMixed, boundary))
+	return
+}
+
+// maxHeaderLine is the length header lines are folded to where the value has
+// spaces (RFC 5322 section 2.1.1)
+const maxHeaderLine = 78
+
+// writeHeader writes the header block (and the blank line that ends it) in the
+// same sorted order mime/multipart uses for parts. Long values are folded.
+func writeHeader(w io.Writer, header textproto.MIMEHeader) (err error) {
+	return writeHeaderOrder(w, header, nil)
+}
+
+// writeHeaderOrder is writeHeader keeping the order the keys were read in
+// (see readHeader), one value for each time a key is in order. Keys not in
+// order are written after, sorted.
+func writeHeaderOrder(w io.Writer, header textproto.MIMEHeader, order []string) (err error) {
+	bw := bufio.NewWriter(w)
+
+	written := map[string]int{}
+	for _, k := range order {
+		if i := written[k]; i < len(header[k]) {
+			fmt.Fprintf(bw, "%s\r\n", foldHeaderLine(k, header[k][i]))
+			written[k]++
+		}
+	}
+
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		for _, v := range header[k][written[k]:] {
+			fmt.Fprintf(bw, "%s\r\n", foldHeaderLine(k, v))
+		}
+	}
+	fmt.Fprintf(bw, "\r\n")
+
+	return bw.Flush()
+}
+
+// foldHeaderLine is "Key: value" folded before spaces, so lines are no longer
+// than maxHeaderLine where the value allows it (and a value read unfolded
+// fits the 998 octet limit again). Unfolding gives the same value back.
+func foldHeaderLine(key, value string) string {
+	line := key + ": " + value
+	if len(line) <= maxHeaderLine {
+		return line
+	}
+
+	var b strings.Builder
+	for i, l := range strings.Split(line, "\r\n") {
+		// Values can already be folded (see AddressList)
+		start := 1
+		if i == 0 {
+			start = len(key) + 2
+		} else {
+			b.WriteString("\r\n")
+		}
+
+		for len(l) > maxHeaderLine {
+			at := foldIndex(l, start)
+			if at < 0 {
+				break
+			}
+			b.WriteString(l[:at])
+			b.WriteString("\r\n")
+			l, start = l[at:], 1
+		}
+		b.WriteString(l)
+	}
+	return b.String()
+}
+
+// foldIndex of the space to fold the line before: the last one keeping the
+// line within maxHeaderLine, or else the first one. Only single spaces are
+// used, textproto unfolds them back as they were.
+func foldIndex(l string, start int) (at int) {
+	at = -1
+	for i := start; i < len(l)-1; i++ {
+		if l[i] != ' ' || l[i-1] == ' ' || l[i+1] == ' ' {
+			continue
+		}
+		if i > maxHeaderLine {
+			if at < 0 {
+				at = i
+			}
+			break
+		}
+		at = i
+	}
+	return
+}
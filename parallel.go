@@ -0,0 +1,194 @@
+package mimestream
+
+import (
+	"context"
+	"io"
+	"mime/multipart"
+)
+
+// DefaultSpoolMemory is the memory budget for pre-encoded attachments when
+// Writer.Workers is set without Writer.SpoolMemory
+var DefaultSpoolMemory int64 = 32 * 1024 * 1024
+
+// encodeJob base64 encodes a File into a spool ahead of its turn
+type encodeJob struct {
+	file  File
+	path  string
+	spool *spool
+	err   error
+	done  chan struct{}
+}
+
+// preEncoder runs the encodeJobs of the File parts of a single Parts. At
+// most Workers jobs are started but not yet written, so the spools stay
+// bounded however many parts there are.
+type preEncoder struct {
+	s      *writeState
+	ctx    context.Context
+	cancel context.CancelFunc
+	path   string
+	parts  Parts
+	jobs   []*encodeJob
+
+	// next part to consider for a job and the jobs started but not written
+	next    int
+	pending int
+}
+
+// preEncode returns nil unless the Writer has Workers and there are at least
+// two File parts to encode side by side
+func (s *writeState) preEncode(path string, parts Parts) *preEncoder {
+	if s.opts.Workers < 2 {
+		return nil
+	}
+
+	var files int
+	for _, part := range parts {
+		if _, ok := part.(File); ok {
+			files++
+		}
+	}
+	if files < 2 {
+		return nil
+	}
+
+	s.once.Do(func() {
+		s.workers = make(chan struct{}, s.opts.Workers)
+
+		budget := s.opts.SpoolMemory
+		if budget == 0 {
+			budget = DefaultSpoolMemory
+		}
+		s.budget = &spoolBudget{free: budget}
+	})
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	return &preEncoder{
+		s:      s,
+		ctx:    ctx,
+		cancel: cancel,
+		path:   path,
+		parts:  parts,
+		jobs:   make([]*encodeJob, len(parts)),
+	}
+}
+
+// job starts the jobs that fit in the window and returns the job of part i
+// (nil for parts written directly)
+func (pe *preEncoder) job(i int) *encodeJob {
+	if pe == nil {
+		return nil
+	}
+
+	if pe.next < i {
+		pe.next = i
+	}
+
+	for pe.next < len(pe.parts) && pe.pending < pe.s.opts.Workers {
+		if f, ok := pe.parts[pe.next].(File); ok {
+			job := &encodeJob{
+				file:  f,
+				path:  childPath(pe.path, pe.next),
+				spool: &spool{budget: pe.s.budget, dir: pe.s.opts.SpoolDir},
+				done:  make(chan struct{}),
+			}
+			pe.jobs[pe.next] = job
+			pe.pending++
+			go pe.s.encode(pe.ctx, job)
+		}
+		pe.next++
+	}
+
+	job := pe.jobs[i]
+	if job != nil {
+		<-job.done
+		pe.pending--
+	}
+	return job
+}
+
+// closeRest closes the sources of the parts from i on, except the Files that
+// have a job (which close their own)
+func (pe *preEncoder) closeRest(parts Parts, i int) (err error) {
+	if pe == nil {
+		return closeParts(parts[i:])
+	}
+
+	for j := i; j < len(parts); j++ {
+		if pe.jobs[j] == nil {
+			err = appendError(err, closeParts(parts[j:j+1]))
+		}
+	}
+	return
+}
+
+// stop cancels the jobs still running and removes the spools of the jobs that
+// were never written
+func (pe *preEncoder) stop() {
+	if pe == nil {
+		return
+	}
+
+	pe.cancel()
+	for _, job := range pe.jobs {
+		if job != nil {
+			<-job.done
+			job.spool.Close()
+		}
+	}
+}
+
+// encode runs in its own goroutine once a worker is free
+func (s *writeState) encode(ctx context.Context, job *encodeJob) {
+	defer close(job.done)
+
+	select {
+	case s.workers <- struct{}{}:
+		defer func() { <-s.workers }()
+	case <-ctx.Done():
+		job.err = appendError(ctx.Err(), s.closed(job.file.closeSources()))
+		return
+	}
+
+	var err error
+	job.file, err = job.file.sniff(s.opts.Sniff)
+	if err != nil {
+		job.err = appendError(err, s.closed(job.file.closeSources()))
+		return
+	}
+
+	p := s.startPart(job.path, job.file)
+
+	encoder := NewMimeBase64Writer(job.spool)
+	_, err = copyContext(ctx, encoder, p.reader(job.file.Reader))
+	if err == nil {
+		err = encoder.Close()
+	}
+
+	job.err = appendError(err, s.closed(job.file.closeSources()))
+}
+
+// write the encoded File to w in its place. The spool is released right after
+// so its memory goes to the Files still to be encoded.
+func (job *encodeJob) write(s *writeState, w *multipart.Writer) (err error) {
+	defer job.spool.Close()
+
+	if job.err != nil {
+		return job.err
+	}
+
+	var part io.Writer
+	part, err = w.CreatePart(job.file.header())
+	if err != nil {
+		return
+	}
+
+	var r io.Reader
+	r, err = job.spool.reader()
+	if err != nil {
+		return
+	}
+
+	_, err = copyContext(s.ctx, s.progress(job.path).writer(part), r)
+	return
+}
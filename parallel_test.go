@@ -0,0 +1,160 @@
+package mimestream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// workersParts has Files of different sizes at two levels
+func workersParts(closers []*trackedCloser, broken int) Parts {
+	file := func(i int, size int) File {
+		var r io.Reader = strings.NewReader(strings.Repeat(string(rune('a'+i)), size))
+		if i == broken {
+			r = &failingReader{n: size / 2}
+		}
+		return File{Name: "file.txt", Reader: r, Closer: closers[i]}
+	}
+
+	return Parts{
+		Text{Text: "Hello"},
+		file(0, 100000),
+		file(1, 10),
+		Mixed{Parts: Parts{
+			file(2, 50000),
+			Text{Text: "nested"},
+			file(3, 200000),
+			file(4, 1),
+		}},
+		file(5, 300000),
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mimestream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	closers := func() []*trackedCloser {
+		c := make([]*trackedCloser, 6)
+		for i := range c {
+			c[i] = &trackedCloser{}
+		}
+		return c
+	}
+
+	var want bytes.Buffer
+	err = (&Writer{Boundary: HashBoundaries("workers")}).Into(multipart.NewWriter(&want), workersParts(closers(), -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		memory int64
+	}{
+		{"memory", 0},
+		{"temp files", 1024},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wr := &Writer{Boundary: HashBoundaries("workers"), Workers: 3, SpoolMemory: test.memory, SpoolDir: dir}
+
+			c := closers()
+			var got bytes.Buffer
+			err := wr.Into(multipart.NewWriter(&got), workersParts(c, -1))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got.Bytes(), want.Bytes()) {
+				t.Errorf("Invalid output:\n\tGot:%d bytes\n\tWant:%d bytes\n", got.Len(), want.Len())
+			}
+
+			// A failure in the middle still closes every File once
+			c = closers()
+			err = wr.Into(multipart.NewWriter(ioutil.Discard), workersParts(c, 2))
+			if !errors.Is(err, errInjected) {
+				t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, errInjected)
+			}
+
+			for i, closer := range c {
+				if closer.n != 1 {
+					t.Errorf("Invalid number of Close calls for file %d:\n\tGot:%d\n\tWant:%d\n", i, closer.n, 1)
+				}
+			}
+
+			names, _ := ioutil.ReadDir(dir)
+			if len(names) != 0 {
+				t.Errorf("Spool files left behind: %d", len(names))
+			}
+		})
+	}
+}
+
+func TestWorkersReleaseSpools(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mimestream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var parts Parts
+	for i := 0; i < 8; i++ {
+		parts = append(parts, File{Name: "file.bin", Reader: mockDataSrc(64 * 1024)})
+	}
+
+	// Each File takes two 64KB blocks once encoded. The memory is enough for
+	// the Workers spools (and the one being written) but not for every File.
+	var mu sync.Mutex
+	var spilled int
+	wr := &Writer{Workers: 2, SpoolMemory: 4 * 128 * 1024, SpoolDir: dir, Progress: func(e ProgressEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		if names, _ := ioutil.ReadDir(dir); len(names) > spilled {
+			spilled = len(names)
+		}
+	}}
+
+	err = wr.Into(multipart.NewWriter(ioutil.Discard), parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if spilled != 0 {
+		t.Errorf("Invalid number of temp files:\n\tGot:%d\n\tWant:%d\n", spilled, 0)
+	}
+}
+
+func benchmarkWorkers(b *testing.B, workers int) {
+	size := int64(4 * 1024 * 1024)
+	files := 8
+
+	b.SetBytes(size * int64(files))
+	for i := 0; i < b.N; i++ {
+		var parts Parts
+		for j := 0; j < files; j++ {
+			parts = append(parts, File{Name: "file.bin", Reader: mockDataSrc(size)})
+		}
+
+		err := (&Writer{Workers: workers}).Into(multipart.NewWriter(ioutil.Discard), parts)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkIntoSequential(b *testing.B) { benchmarkWorkers(b, 0) }
+
+func BenchmarkIntoWorkers4(b *testing.B) { benchmarkWorkers(b, 4) }
+
+func BenchmarkIntoWorkers8(b *testing.B) { benchmarkWorkers(b, 8) }
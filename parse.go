@@ -0,0 +1,125 @@
+package mimestream
+
+import (
+	"bufio"
+	"io"
+	"net/textproto"
+	"sync"
+)
+
+// PartResult is what happened to a leaf part, see Parser.Report
+type PartResult struct {
+	// Path of the part (see BoundaryFunc)
+	Path   string
+	Header textproto.MIMEHeader
+
+	// Type compares the declared and detected type of the body
+	Type TypeCheck
+
+	// Err is the error returned by the handler
+	Err error
+}
+
+// parseState is shared by every part of a single parse
+type parseState struct {
+	ps      *Parser
+	results []PartResult
+
+	// With Parser.Workers
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	workers chan struct{}
+	budget  *spoolBudget
+}
+
+func (ps *Parser) newParseState() *parseState {
+	st := &parseState{ps: ps}
+	if ps.Workers > 1 {
+		budget := ps.SpoolMemory
+		if budget == 0 {
+			budget = DefaultSpoolMemory
+		}
+		st.workers = make(chan struct{}, ps.Workers)
+		st.budget = &spoolBudget{free: budget}
+	}
+	return st
+}
+
+// leaf passes a leaf part to the handler, or to a worker once the body is
+// spooled
+func (st *parseState) leaf(path string, header textproto.MIMEHeader, body io.Reader, handler partHandler) (err error) {
+	result := PartResult{Path: path, Header: header}
+
+	// Read errors are left to the handler
+	if br, ok := body.(*bufio.Reader); ok {
+		result.Type, _ = sniffPart(header, br)
+	}
+
+	st.mu.Lock()
+	i := len(st.results)
+	st.results = append(st.results, result)
+	st.mu.Unlock()
+
+	if st.ps.Sanitizer != nil {
+		handler = st.ps.Sanitizer.handler(handler)
+	}
+
+	if st.workers == nil {
+		err = handler(header, body)
+		st.results[i].Err = err
+		return
+	}
+
+	// The body has to be read now for the parser to reach the next part
+	sp := &spool{budget: st.budget, dir: st.ps.SpoolDir}
+	_, err = io.Copy(sp, body)
+	if err != nil {
+		sp.Close()
+		return
+	}
+
+	var r io.Reader
+	r, err = sp.reader()
+	if err != nil {
+		sp.Close()
+		return
+	}
+
+	// Blocks while every worker is busy, so only Workers bodies are spooled
+	// (plus the one being read)
+	st.workers <- struct{}{}
+	st.wg.Add(1)
+
+	go func() {
+		defer st.wg.Done()
+		defer func() { <-st.workers }()
+		defer sp.Close()
+
+		herr := handler(header, r)
+
+		st.mu.Lock()
+		st.results[i].Err = herr
+		st.mu.Unlock()
+	}()
+	return
+}
+
+// finish waits for the workers and calls Parser.Report. Without a parse
+// error, the first handler error in part order is returned.
+func (st *parseState) finish(err error) error {
+	st.wg.Wait()
+
+	if st.workers != nil && err == nil {
+		for _, result := range st.results {
+			if result.Err != nil {
+				err = result.Err
+				break
+			}
+		}
+	}
+
+	if st.ps.Report != nil {
+		st.ps.Report(st.results)
+	}
+	return err
+}
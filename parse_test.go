@@ -0,0 +1,154 @@
+package mimestream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParserWorkers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mimestream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	large := strings.Repeat("large ", 100000)
+
+	var buf bytes.Buffer
+	err = Message{Parts: Parts{
+		Text{Text: "one"},
+		File{Name: "two.txt", Reader: strings.NewReader(large)},
+		Mixed{Parts: Parts{
+			Text{Text: "three"},
+			File{Name: "four.txt", Reader: strings.NewReader("four")},
+		}},
+		Text{Text: "five"},
+	}}.Into(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantBodies := map[string]string{"1": "one", "2": large, "3.1": "three", "3.2": "four", "4": "five"}
+	wantPaths := []string{"1", "2", "3.1", "3.2", "4"}
+
+	var mu sync.Mutex
+	var running, maxRunning int
+	bodies := map[string]string{}
+
+	var report []PartResult
+	ps := &Parser{
+		Workers:     2,
+		SpoolMemory: 1024,
+		SpoolDir:    dir,
+		Report: func(results []PartResult) {
+			report = results
+		},
+	}
+
+	errFour := errors.New("four failed")
+	errFive := errors.New("five failed")
+
+	err = ps.HandleEmailFromReader(bytes.NewReader(buf.Bytes()), func(header textproto.MIMEHeader, body io.Reader) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			return err
+		}
+
+		// Part four fails after part five
+		if string(b) == "four" {
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		running--
+		bodies[fmt.Sprint(len(bodies))] = string(b)
+
+		switch string(b) {
+		case "four":
+			return errFour
+		case "five":
+			return errFive
+		}
+		return nil
+	})
+
+	// The first error in part order, whichever finished first
+	if err != errFour {
+		t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, errFour)
+	}
+
+	var paths []string
+	for _, result := range report {
+		paths = append(paths, result.Path)
+	}
+	if !reflect.DeepEqual(paths, wantPaths) {
+		t.Errorf("Invalid report paths:\n\tGot:%v\n\tWant:%v\n", paths, wantPaths)
+	}
+
+	if len(report) == 5 && (report[3].Err != errFour || report[4].Err != errFive || report[0].Err != nil) {
+		t.Errorf("Invalid report:\n\tGot:%+v\n", report)
+	}
+
+	if maxRunning > 2 {
+		t.Errorf("Too many handlers at once:\n\tGot:%d\n\tWant:%d\n", maxRunning, 2)
+	}
+
+	// Every body arrived intact
+	found := map[string]bool{}
+	for _, b := range bodies {
+		found[b] = true
+	}
+	for path, body := range wantBodies {
+		if !found[body] {
+			t.Errorf("Missing body of part %s", path)
+		}
+	}
+
+	names, _ := ioutil.ReadDir(dir)
+	if len(names) != 0 {
+		t.Errorf("Spool files left behind: %d", len(names))
+	}
+}
+
+func TestParserWorkersLimits(t *testing.T) {
+	defer func(max int) { MaximumPartsPerMultipart = max }(MaximumPartsPerMultipart)
+	MaximumPartsPerMultipart = 2
+
+	var buf bytes.Buffer
+	err := Message{Parts: Parts{Text{Text: "one"}, Text{Text: "two"}, Text{Text: "three"}}}.Into(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report []PartResult
+	ps := &Parser{Workers: 4, Report: func(results []PartResult) { report = results }}
+
+	err = ps.HandleEmailFromReader(&buf, func(header textproto.MIMEHeader, body io.Reader) error {
+		return nil
+	})
+	if err != ErrMaximumPartsPerMultipart {
+		t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, ErrMaximumPartsPerMultipart)
+	}
+
+	if len(report) != 2 {
+		t.Errorf("Invalid number of parts handled:\n\tGot:%d\n\tWant:%d\n", len(report), 2)
+	}
+}
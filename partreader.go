@@ -0,0 +1,140 @@
+package mimestream
+
+import (
+	"bufio"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
+// Leaf is a part that is not a multipart, as returned by PartReader.Next
+type Leaf struct {
+	Header textproto.MIMEHeader
+
+	// Path of the part (see BoundaryFunc)
+	Path string
+
+	// Body is the decoded body. It is only valid until the next call to Next.
+	Body io.Reader
+
+	// Type compares the declared and detected type of the body
+	Type TypeCheck
+}
+
+// PartReader walks the leaf parts of a message one call at a time, so callers
+// can stop early or mix reading parts with other work. It applies the same
+// limits as HandleEmailFromReader.
+type PartReader struct {
+	tp    *textproto.Reader
+	stack []*partFrame
+	err   error
+
+	started bool
+}
+
+// partFrame is a multipart being walked
+type partFrame struct {
+	mr    *multipart.Reader
+	path  string
+	level int
+	count int
+}
+
+// NewPartReader reads the message from r (in RFC 5322 format)
+func NewPartReader(r io.Reader) *PartReader {
+	return &PartReader{tp: textproto.NewReader(bufioReader(r))}
+}
+
+// Next returns the next leaf part, or io.EOF once there are no more. Whatever
+// was not read of the previous Body is skipped. Errors are sticky.
+func (pr *PartReader) Next() (leaf *Leaf, err error) {
+	if pr.err != nil {
+		return nil, pr.err
+	}
+
+	leaf, err = pr.next()
+	if err != nil {
+		pr.err = err
+	}
+	return
+}
+
+func (pr *PartReader) next() (*Leaf, error) {
+	if !pr.started {
+		pr.started = true
+
+		header, err := pr.tp.ReadMIMEHeader()
+		if err != nil {
+			return nil, err
+		}
+
+		leaf, err := pr.push("", header, pr.tp.R, 0)
+		if leaf != nil || err != nil {
+			return leaf, err
+		}
+	}
+
+	for len(pr.stack) > 0 {
+		frame := pr.stack[len(pr.stack)-1]
+
+		p, err := frame.mr.NextPart()
+		if err == io.EOF {
+			pr.stack = pr.stack[:len(pr.stack)-1]
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Protect against bad actors
+		frame.count++
+		if frame.count > MaximumPartsPerMultipart {
+			return nil, ErrMaximumPartsPerMultipart
+		}
+
+		leaf, err := pr.push(childPath(frame.path, frame.count-1), p.Header, contentDecoderReader(p.Header, p), frame.level+1)
+		if leaf != nil || err != nil {
+			return leaf, err
+		}
+	}
+
+	return nil, io.EOF
+}
+
+// push returns the leaf or, for a multipart, adds it to the stack
+func (pr *PartReader) push(path string, header textproto.MIMEHeader, body io.Reader, level int) (*Leaf, error) {
+	ct, params, err := parseContentType(header)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(ct, "multipart/") {
+		var br *bufio.Reader
+		if level == 0 {
+			br = contentDecoderReader(header, body)
+		} else {
+			br = bufioReader(body)
+		}
+
+		// Read errors are left to whoever reads the body
+		check, _ := sniffPart(header, br)
+		return &Leaf{Header: header, Path: path, Body: br, Type: check}, nil
+	}
+
+	// Protect against bad actors
+	if level > MaximumMultipartDepth {
+		return nil, ErrMaximumMultipartDepth
+	}
+
+	if _, ok := params["boundary"]; !ok {
+		return nil, ErrMissingBoundary
+	}
+
+	pr.stack = append(pr.stack, &partFrame{
+		mr:    multipart.NewReader(body, params["boundary"]),
+		path:  path,
+		level: level,
+	})
+	return nil, nil
+}
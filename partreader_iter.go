@@ -0,0 +1,35 @@
+//go:build go1.23
+
+package mimestream
+
+import (
+	"io"
+	"iter"
+)
+
+// All iterates over the remaining leaf parts. An error is yielded once, with a
+// nil Leaf, and ends the iteration.
+//
+//	for leaf, err := range mimestream.NewPartReader(r).All() {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+func (pr *PartReader) All() iter.Seq2[*Leaf, error] {
+	return func(yield func(*Leaf, error) bool) {
+		for {
+			leaf, err := pr.Next()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(leaf, nil) {
+				return
+			}
+		}
+	}
+}
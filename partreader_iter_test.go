@@ -0,0 +1,30 @@
+//go:build go1.23
+
+package mimestream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestPartReaderAll(t *testing.T) {
+	var got []string
+	for leaf, err := range NewPartReader(bytes.NewReader(partReaderMessage(t))).All() {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, _ := ioutil.ReadAll(leaf.Body)
+		got = append(got, string(b))
+
+		// Stopping early is just a break
+		if len(got) == 2 {
+			break
+		}
+	}
+
+	if len(got) != 2 || got[0] != "one" || got[1] != "two" {
+		t.Errorf("Invalid bodies:\n\tGot:%q\n\tWant:%q\n", got, []string{"one", "two"})
+	}
+}
@@ -0,0 +1,131 @@
+package mimestream
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func partReaderMessage(t *testing.T) []byte {
+	var buf bytes.Buffer
+	err := (&Writer{Boundary: HashBoundaries("partreader")}).WriteMessage(&buf, Message{Parts: Parts{
+		Text{Text: "one"},
+		Mixed{Parts: Parts{
+			File{Name: "two.txt", Reader: strings.NewReader("two")},
+			Alternative{Parts: Parts{
+				Text{Text: "three"},
+				Text{Text: "<b>four</b>", ContentType: TextHTML},
+			}},
+		}},
+		Text{Text: "five"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPartReader(t *testing.T) {
+	message := partReaderMessage(t)
+
+	// The callback API gives the reference result
+	var want []string
+	err := HandleEmailFromReader(bytes.NewReader(message), func(header textproto.MIMEHeader, body io.Reader) error {
+		b, err := ioutil.ReadAll(body)
+		want = append(want, string(b))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got, paths []string
+	pr := NewPartReader(bytes.NewReader(message))
+	for {
+		leaf, err := pr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := ioutil.ReadAll(leaf.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(b))
+		paths = append(paths, leaf.Path)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Invalid bodies:\n\tGot:%q\n\tWant:%q\n", got, want)
+	}
+
+	wantPaths := []string{"1", "2.1", "2.2.1", "2.2.2", "3"}
+	if !reflect.DeepEqual(paths, wantPaths) {
+		t.Errorf("Invalid paths:\n\tGot:%v\n\tWant:%v\n", paths, wantPaths)
+	}
+
+	// Bodies that are not read are skipped
+	pr = NewPartReader(bytes.NewReader(message))
+	var n int
+	for {
+		_, err := pr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if n != len(want) {
+		t.Errorf("Invalid number of leaves:\n\tGot:%d\n\tWant:%d\n", n, len(want))
+	}
+}
+
+func TestPartReaderSinglePart(t *testing.T) {
+	pr := NewPartReader(strings.NewReader("Content-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\naGVsbG8=\r\n"))
+
+	leaf, err := pr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := ioutil.ReadAll(leaf.Body)
+	if string(b) != "hello" || leaf.Path != "" {
+		t.Errorf("Invalid leaf:\n\tGot:%q %q\n\tWant:%q %q\n", leaf.Path, b, "", "hello")
+	}
+
+	_, err = pr.Next()
+	if err != io.EOF {
+		t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, io.EOF)
+	}
+}
+
+func TestPartReaderLimits(t *testing.T) {
+	defer func(max int) { MaximumMultipartDepth = max }(MaximumMultipartDepth)
+	MaximumMultipartDepth = 1
+
+	pr := NewPartReader(bytes.NewReader(partReaderMessage(t)))
+
+	var err error
+	for err == nil {
+		_, err = pr.Next()
+	}
+
+	if err != ErrMaximumMultipartDepth {
+		t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, ErrMaximumMultipartDepth)
+	}
+
+	// Errors are sticky
+	_, err = pr.Next()
+	if err != ErrMaximumMultipartDepth {
+		t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, ErrMaximumMultipartDepth)
+	}
+}
@@ -1,7 +1,7 @@
 package mimestream
 
 import (
-	"fmt"
+	"context"
 	"mime/multipart"
 
 	"github.com/pkg/errors"
@@ -37,14 +37,12 @@ type Parts []Part
 
 // Into the given multipart.Writer
 func (p Parts) Into(w *multipart.Writer) (err error) {
-	for _, part := range p {
-		err = part.Add(w)
-		if err != nil {
-			err = errors.Wrap(err, fmt.Sprintf("failed to add %T part %v", part, part))
-			return
-		}
-	}
-	return w.Close()
+	return (&Writer{}).Into(w, p)
+}
+
+// IntoContext is Into stopping as soon as ctx is done (see Writer.IntoContext)
+func (p Parts) IntoContext(ctx context.Context, w *multipart.Writer) (err error) {
+	return (&Writer{}).IntoContext(ctx, w, p)
 }
 
 // Part defines a named part inside of a multipart message.
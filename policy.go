@@ -0,0 +1,522 @@
+package mimestream
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/textproto"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrPolicyRejected is returned by Policy.Rewrite when a part breaks a rule
+// and Policy.RejectMessage is set
+var ErrPolicyRejected = errors.New("Mimestream: Message rejected by attachment policy")
+
+// Archives are read into memory to look inside, larger ones are treated as
+// unreadable
+var MaximumArchiveSize int64 = 1024 * 1024 * 25
+
+// Archives inside archives are opened up to this depth
+var MaximumArchiveDepth = 3
+
+// ExecutableExtensions are the extensions checked by
+// Policy.DenyDoubleExtensions
+var ExecutableExtensions = []string{
+	".exe", ".scr", ".com", ".pif", ".bat", ".cmd", ".msi", ".dll", ".cpl",
+	".js", ".jse", ".vbs", ".vbe", ".wsf", ".hta", ".ps1", ".jar", ".lnk",
+}
+
+// Policy decides which attachments of inbound messages are accepted. Rules
+// are checked for every leaf part; extension rules only apply to parts with a
+// filename. Extensions and types are lower case, extensions with the dot.
+// Forwarded messages (message/rfc822) are rejected when one of their parts
+// is, up to MaximumMultipartDepth forwards deep.
+type Policy struct {
+	// AllowExtensions only accepts these extensions (when not empty)
+	AllowExtensions []string
+	DenyExtensions  []string
+
+	// AllowTypes only accepts these declared types (when not empty).
+	// DenyTypes matches the declared or the detected type.
+	AllowTypes []string
+	DenyTypes  []string
+
+	// DenyExecutables rejects bodies that look like programs whatever their
+	// name or declared type
+	DenyExecutables bool
+
+	// DenyMismatch rejects bodies that are not what their type says (see
+	// TypeCheck.Mismatch)
+	DenyMismatch bool
+
+	// DenyDoubleExtensions rejects names like "invoice.pdf.exe" which end in
+	// one of ExecutableExtensions
+	DenyDoubleExtensions bool
+
+	// MaxSize is the limit of a decoded body in bytes (0 for no limit)
+	MaxSize int64
+
+	// ScanArchives applies the extension rules, DenyDoubleExtensions and
+	// DenyExecutables to the files inside zip archives. DenyEncryptedArchives rejects password
+	// protected ones, which can not be looked into.
+	ScanArchives          bool
+	DenyEncryptedArchives bool
+
+	// RejectMessage makes Rewrite fail with ErrPolicyRejected instead of
+	// replacing the offending parts
+	RejectMessage bool
+
+	// Notice is the text that replaces a part (optional)
+	Notice func(v Verdict) string
+
+	// SpoolMemory and SpoolDir are used by Rewrite to hold parts until they
+	// are checked (see Parser)
+	SpoolMemory int64
+	SpoolDir    string
+}
+
+// Verdict is the outcome of the Policy for a leaf part
+type Verdict struct {
+	// Path of the part (see BoundaryFunc)
+	Path   string
+	Header textproto.MIMEHeader
+
+	// Name is the filename (if any)
+	Name string
+	Type TypeCheck
+
+	// Size of the decoded body (MaxSize + 1 when it is larger than MaxSize)
+	Size int64
+
+	// Reason is empty for accepted parts
+	Reason string
+}
+
+// Accepted reports if the part broke no rule
+func (v Verdict) Accepted() bool {
+	return v.Reason == ""
+}
+
+// Check returns the verdict for every leaf part of the message in r
+func (p *Policy) Check(r io.Reader) (verdicts []Verdict, err error) {
+	pr := &policyRewriter{p: p}
+	err = rewriteMessage(defaultState(), r, ioutil.Discard, pr)
+	return pr.verdicts, err
+}
+
+// Rewrite copies the message from r to w, replacing every part that breaks a
+// rule with a text notice. Parts are held (in memory up to SpoolMemory, then
+// in temp files) until they are checked.
+func (p *Policy) Rewrite(r io.Reader, w io.Writer) (verdicts []Verdict, err error) {
+	budget := p.SpoolMemory
+	if budget == 0 {
+		budget = DefaultSpoolMemory
+	}
+
+	pr := &policyRewriter{p: p, budget: &spoolBudget{free: budget}}
+	err = rewriteMessage(defaultState(), r, w, pr)
+	return pr.verdicts, err
+}
+
+// policyRewriter applies a Policy to the leaves, spooling them when there is
+// a budget
+type policyRewriter struct {
+	p        *Policy
+	budget   *spoolBudget
+	verdicts []Verdict
+
+	// depth of forwarded messages being checked
+	depth int
+}
+
+func (pr *policyRewriter) multipart(path string, header textproto.MIMEHeader) (partOutput, error) {
+	return partOutput{header: header, descend: true}, nil
+}
+
+func (pr *policyRewriter) leaf(path string, header textproto.MIMEHeader, raw io.Reader) (out partOutput, err error) {
+	var sp *spool
+	if pr.budget != nil {
+		sp = &spool{budget: pr.budget, dir: pr.p.SpoolDir}
+	}
+
+	v, complete, err := pr.p.inspect(path, header, raw, sp, pr.depth)
+	pr.verdicts = append(pr.verdicts, v)
+	if err != nil {
+		if sp != nil {
+			sp.Close()
+		}
+		return
+	}
+
+	// Only checking, nothing is written
+	if sp == nil {
+		out.header = header
+		out.write = func(io.Writer) error { return nil }
+		return
+	}
+
+	if v.Accepted() && complete {
+		out.header = header
+		out.write = func(w io.Writer) error {
+			defer sp.Close()
+
+			body, err := sp.reader()
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(w, body)
+			return err
+		}
+		return
+	}
+	sp.Close()
+
+	if pr.p.RejectMessage {
+		return out, ErrPolicyRejected
+	}
+
+	out, err = pr.p.notice(v)
+	if path == "" {
+		out.header = noticeMessageHeader(header, out.header)
+	}
+	return
+}
+
+// noticeMessageHeader keeps the header of a rejected single part message
+// (From, Subject, Date...) with the content fields of the notice. The
+// Content-Disposition of the removed body goes too.
+func noticeMessageHeader(header, notice textproto.MIMEHeader) textproto.MIMEHeader {
+	copied := textproto.MIMEHeader{}
+	for k, v := range header {
+		copied[k] = v
+	}
+	copied.Del("Content-Disposition")
+	for k, v := range notice {
+		copied[k] = v
+	}
+	return copied
+}
+
+// notice is the part replacing a rejected one
+func (p *Policy) notice(v Verdict) (out partOutput, err error) {
+	var text string
+	if p.Notice != nil {
+		text = p.Notice(v)
+	} else if v.Name != "" {
+		text = fmt.Sprintf("The attachment %q was removed: %s.\r\n", v.Name, v.Reason)
+	} else {
+		text = fmt.Sprintf("A part of this message was removed: %s.\r\n", v.Reason)
+	}
+
+	out.header = quotedPartHeader(TextPlain)
+	out.write = func(w io.Writer) error {
+		return encodeBody(w, out.header, strings.NewReader(text))
+	}
+	return
+}
+
+// inspect reads the whole part and applies the rules. The raw body is copied
+// to sp (when given) unless the part is too large; complete reports if sp
+// holds the whole body. Forwarded messages are checked as they are read, depth
+// is how many forwards deep the part is.
+func (p *Policy) inspect(path string, header textproto.MIMEHeader, raw io.Reader, sp *spool, depth int) (v Verdict, complete bool, err error) {
+	v = Verdict{Path: path, Header: header, Name: partFilename(header)}
+	v.Type.Declared, _, _ = mime.ParseMediaType(header.Get("Content-Type"))
+
+	body := raw
+	if sp != nil {
+		body = io.TeeReader(raw, sp)
+	}
+
+	in := &inspector{scan: p.ScanArchives}
+
+	var dst io.Writer = in
+	var fc *forwardChecker
+	forwarded := v.Type.Declared == "message/rfc822" || v.Type.Declared == "message/global"
+	if forwarded && depth < MaximumMultipartDepth {
+		fc = p.checkForwarded(depth + 1)
+		defer fc.stop()
+		dst = io.MultiWriter(in, fc)
+	}
+
+	var n int64
+	if p.MaxSize > 0 {
+		n, err = io.Copy(dst, io.LimitReader(contentDecoderReader(header, body), p.MaxSize+1))
+	} else {
+		n, err = io.Copy(dst, contentDecoderReader(header, body))
+	}
+	if err != nil {
+		return
+	}
+	v.Size = n
+	v.Type.Detected = DetectContentType(in.head)
+
+	// Whatever the decoder did not need (or the rest of a part that is too
+	// large), so the next part can be read
+	var w io.Writer = ioutil.Discard
+	if sp != nil && (p.MaxSize == 0 || n <= p.MaxSize) {
+		w = sp
+	}
+	_, err = io.Copy(w, raw)
+	if err != nil {
+		return
+	}
+	complete = w != ioutil.Discard
+
+	v.Reason = p.reason(v, in)
+	if v.Reason == "" && forwarded {
+		if fc == nil {
+			v.Reason = "forwarded message nested too deep to scan"
+		} else {
+			v.Reason = fc.reason()
+		}
+	}
+	return
+}
+
+// reason why the part breaks the rules (empty if it does not)
+func (p *Policy) reason(v Verdict, in *inspector) string {
+	if p.MaxSize > 0 && v.Size > p.MaxSize {
+		return fmt.Sprintf("larger than %d bytes", p.MaxSize)
+	}
+
+	if v.Name != "" {
+		if reason := p.nameReason(v.Name); reason != "" {
+			return reason
+		}
+	}
+
+	if p.DenyExecutables && v.Type.Executable() {
+		return "executable content"
+	}
+
+	if p.DenyMismatch && v.Type.Mismatch() {
+		return fmt.Sprintf("declared as %s but looks like %s", v.Type.Declared, v.Type.Detected)
+	}
+
+	if len(p.AllowTypes) > 0 && !contains(p.AllowTypes, v.Type.Declared) {
+		return fmt.Sprintf("type %s not allowed", v.Type.Declared)
+	}
+
+	for _, t := range []string{v.Type.Declared, v.Type.Detected} {
+		if contains(p.DenyTypes, t) {
+			return fmt.Sprintf("type %s not allowed", t)
+		}
+	}
+
+	if p.ScanArchives && in.isZip() {
+		if in.tooLarge {
+			return "archive too large to scan"
+		}
+		return p.archiveReason(in.archive.Bytes(), 1)
+	}
+	return ""
+}
+
+// nameReason checks the extension rules for a filename
+func (p *Policy) nameReason(name string) string {
+	ext := strings.ToLower(path.Ext(strings.TrimRight(name, ". ")))
+
+	if len(p.AllowExtensions) > 0 && !contains(p.AllowExtensions, ext) {
+		return fmt.Sprintf("extension %q not allowed", ext)
+	}
+	if contains(p.DenyExtensions, ext) {
+		return fmt.Sprintf("extension %q not allowed", ext)
+	}
+
+	if p.DenyDoubleExtensions && contains(ExecutableExtensions, ext) {
+		base := strings.TrimRight(strings.TrimSuffix(strings.ToLower(name), ext), ". ")
+		if path.Ext(base) != "" {
+			return fmt.Sprintf("double extension in %q", name)
+		}
+	}
+	return ""
+}
+
+// archiveReason checks the files inside a zip archive
+func (p *Policy) archiveReason(data []byte, depth int) string {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "unreadable archive"
+	}
+
+	for _, f := range zr.File {
+		if f.Flags&0x1 != 0 {
+			if p.DenyEncryptedArchives {
+				return "password protected archive"
+			}
+			continue
+		}
+
+		if reason := p.nameReason(path.Base(f.Name)); reason != "" {
+			return "archive contains " + f.Name + ": " + reason
+		}
+
+		nested := strings.ToLower(path.Ext(f.Name)) == ".zip"
+		if !nested && !p.DenyExecutables {
+			continue
+		}
+
+		if nested && depth >= MaximumArchiveDepth {
+			return "archive nested too deep to scan"
+		}
+		if nested && int64(f.UncompressedSize64) > MaximumArchiveSize {
+			return "archive too large to scan"
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return "unreadable archive"
+		}
+
+		limit := int64(sniffLen)
+		if nested {
+			limit = MaximumArchiveSize
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(rc, limit))
+		rc.Close()
+		if err != nil {
+			return "unreadable archive"
+		}
+
+		if p.DenyExecutables && (TypeCheck{Detected: DetectContentType(data)}).Executable() {
+			return "archive contains " + f.Name + ": executable content"
+		}
+
+		if !nested {
+			continue
+		}
+
+		if reason := p.archiveReason(data, depth+1); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// forwardChecker applies the Policy to the parts of a forwarded message as its
+// body is written
+type forwardChecker struct {
+	*io.PipeWriter
+	done     chan struct{}
+	verdicts []Verdict
+	err      error
+}
+
+func (p *Policy) checkForwarded(depth int) *forwardChecker {
+	pr, pw := io.Pipe()
+	fc := &forwardChecker{PipeWriter: pw, done: make(chan struct{})}
+
+	go func() {
+		defer close(fc.done)
+
+		rw := &policyRewriter{p: p, depth: depth}
+		fc.err = rewriteMessage(defaultState(), pr, ioutil.Discard, rw)
+		fc.verdicts = rw.verdicts
+
+		// Whatever was not needed, so writes never block
+		io.Copy(ioutil.Discard, pr)
+	}()
+	return fc
+}
+
+// stop ends the body and waits for the check
+func (fc *forwardChecker) stop() {
+	fc.Close()
+	<-fc.done
+}
+
+// reason of the first part that breaks the rules (empty if none does)
+func (fc *forwardChecker) reason() string {
+	fc.stop()
+	if fc.err != nil {
+		return "unreadable forwarded message"
+	}
+
+	for _, v := range fc.verdicts {
+		if v.Accepted() {
+			continue
+		}
+		name := v.Name
+		if name == "" {
+			name = "part " + v.Path
+		}
+		return "forwarded message contains " + name + ": " + v.Reason
+	}
+	return ""
+}
+
+// inspector collects what the rules need from a decoded body in one pass
+type inspector struct {
+	head []byte
+
+	// With scan, zip archives are kept (up to MaximumArchiveSize)
+	scan     bool
+	archive  *bytes.Buffer
+	tooLarge bool
+}
+
+var zipMagic = []byte("PK\x03\x04")
+
+func (in *inspector) Write(b []byte) (int, error) {
+	if len(in.head) < sniffLen {
+		rest := sniffLen - len(in.head)
+		if rest > len(b) {
+			rest = len(b)
+		}
+		in.head = append(in.head, b[:rest]...)
+	}
+
+	// Until the magic bytes are in, anything could be a zip
+	if !in.scan || in.tooLarge || (len(in.head) >= len(zipMagic) && !in.isZip()) {
+		in.archive = nil
+		return len(b), nil
+	}
+
+	if in.archive == nil {
+		in.archive = &bytes.Buffer{}
+	}
+	if int64(in.archive.Len()+len(b)) > MaximumArchiveSize {
+		in.tooLarge = true
+		in.archive = nil
+		return len(b), nil
+	}
+
+	in.archive.Write(b)
+	return len(b), nil
+}
+
+func (in *inspector) isZip() bool {
+	return bytes.HasPrefix(in.head, zipMagic)
+}
+
+// partFilename from the Content-Disposition or Content-Type name parameter
+func partFilename(header textproto.MIMEHeader) string {
+	_, params, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	name := params["filename"]
+	if name == "" {
+		_, params, _ = mime.ParseMediaType(header.Get("Content-Type"))
+		name = params["name"]
+	}
+
+	// Encoded words are not allowed in parameters but widely used
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	return name
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
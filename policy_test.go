@@ -0,0 +1,255 @@
+package mimestream
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// zipOf builds a zip archive, encrypted only sets the flag (enough to detect)
+func zipOf(t *testing.T, encrypted bool, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		fh := &zip.FileHeader{Name: name, Method: zip.Store}
+		if encrypted {
+			fh.Flags |= 0x1
+		}
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func policyMessage(t *testing.T) []byte {
+	exe := "MZ\x90\x00" + strings.Repeat("\x00", 100)
+	pdf := "%PDF-1.4\n" + strings.Repeat("pdf ", 100)
+
+	inner := zipOf(t, false, map[string]string{"setup.exe": exe})
+
+	var buf bytes.Buffer
+	err := (&Writer{Boundary: HashBoundaries("policy")}).WriteMessage(&buf, Message{Parts: Parts{
+		Alternative{Parts: Parts{
+			Text{Text: "Hello"},
+			Text{Text: "<p>Hello</p>", ContentType: TextHTML},
+		}},
+		File{Name: "report.pdf", Reader: strings.NewReader(pdf)},
+		File{Name: "invoice.pdf.exe", ContentType: "application/pdf", Reader: strings.NewReader(pdf)},
+		File{Name: "scan.pdf", Reader: strings.NewReader(exe)},
+		File{Name: "photos.zip", Reader: bytes.NewReader(zipOf(t, false, map[string]string{"a.jpg": "jpg", "nested.zip": string(inner)}))},
+		File{Name: "secret.zip", Reader: bytes.NewReader(zipOf(t, true, map[string]string{"a.txt": "text"}))},
+		File{Name: "large.txt", Reader: strings.NewReader(strings.Repeat("large ", 1000))},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPolicy(t *testing.T) {
+	message := policyMessage(t)
+
+	policy := &Policy{
+		DenyExtensions:        []string{".exe"},
+		DenyExecutables:       true,
+		DenyDoubleExtensions:  true,
+		MaxSize:               1000,
+		ScanArchives:          true,
+		DenyEncryptedArchives: true,
+	}
+
+	want := []struct {
+		path   string
+		reason string
+	}{
+		{"1.1", ""},
+		{"1.2", ""},
+		{"2", ""},
+		{"3", `extension ".exe" not allowed`},
+		{"4", "executable content"},
+		{"5", `archive contains setup.exe: extension ".exe" not allowed`},
+		{"6", "password protected archive"},
+		{"7", "larger than 1000 bytes"},
+	}
+
+	verdicts, err := policy.Check(bytes.NewReader(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(verdicts) != len(want) {
+		t.Fatalf("Invalid number of verdicts:\n\tGot:%d\n\tWant:%d\n", len(verdicts), len(want))
+	}
+
+	for i, w := range want {
+		if verdicts[i].Path != w.path || verdicts[i].Reason != w.reason {
+			t.Errorf("Invalid verdict:\n\tGot:%s %q\n\tWant:%s %q\n", verdicts[i].Path, verdicts[i].Reason, w.path, w.reason)
+		}
+	}
+
+	// Without the extension list, the same parts are caught by other rules
+	policy.DenyExtensions = nil
+	verdicts, _ = policy.Check(bytes.NewReader(message))
+	if len(verdicts) == len(want) {
+		if verdicts[3].Reason != `double extension in "invoice.pdf.exe"` {
+			t.Errorf("Invalid verdict:\n\tGot:%q\n", verdicts[3].Reason)
+		}
+		if verdicts[5].Reason != "archive contains setup.exe: executable content" {
+			t.Errorf("Invalid verdict:\n\tGot:%q\n", verdicts[5].Reason)
+		}
+	}
+
+	// Rewriting replaces the rejected parts and keeps everything else
+	var out bytes.Buffer
+	_, err = policy.Rewrite(bytes.NewReader(message), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bodies := func(r io.Reader) (b []string) {
+		err := HandleEmailFromReader(r, func(header textproto.MIMEHeader, body io.Reader) error {
+			data, err := ioutil.ReadAll(body)
+			b = append(b, string(data))
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	original := bodies(bytes.NewReader(message))
+	rewritten := bodies(&out)
+
+	if len(rewritten) != len(original) {
+		t.Fatalf("Invalid number of parts:\n\tGot:%d\n\tWant:%d\n", len(rewritten), len(original))
+	}
+
+	for i, w := range want {
+		if w.reason == "" && rewritten[i] != original[i] {
+			t.Errorf("Part %s changed:\n\tGot:%q\n\tWant:%q\n", w.path, rewritten[i], original[i])
+		}
+		if w.reason != "" && !strings.Contains(rewritten[i], "was removed") {
+			t.Errorf("Part %s not replaced:\n\tGot:%q\n", w.path, rewritten[i])
+		}
+	}
+
+	// A single part message keeps its header
+	single := strings.Replace(`From: john@example.com
+Subject: Setup
+Mime-Version: 1.0
+Content-Type: application/octet-stream
+Content-Disposition: attachment; filename=x.exe
+Content-Transfer-Encoding: base64
+
+TVqQAA==
+`, "\n", "\r\n", -1)
+
+	out.Reset()
+	_, err = (&Policy{DenyExtensions: []string{".exe"}}).Rewrite(strings.NewReader(single), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := textproto.NewReader(bufioReader(&out)).ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantHeader := textproto.MIMEHeader{
+		"From":                      {"john@example.com"},
+		"Subject":                   {"Setup"},
+		"Mime-Version":              {"1.0"},
+		"Content-Type":              {TextPlain},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	}
+	if !reflect.DeepEqual(header, wantHeader) {
+		t.Errorf("Invalid header:\n\tGot:%v\n\tWant:%v\n", header, wantHeader)
+	}
+
+	// Or the whole message is refused
+	policy.RejectMessage = true
+	_, err = policy.Rewrite(bytes.NewReader(message), ioutil.Discard)
+	if err != ErrPolicyRejected {
+		t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, ErrPolicyRejected)
+	}
+}
+
+func TestPolicyForwarded(t *testing.T) {
+	forward := func(parts Parts) string {
+		var inner bytes.Buffer
+		err := (&Writer{Boundary: HashBoundaries("inner")}).WriteMessage(&inner, Message{
+			Header: textproto.MIMEHeader{"Subject": {"Invoice"}},
+			Parts:  parts,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return strings.Replace(`Subject: Fwd: Invoice
+Mime-Version: 1.0
+Content-Type: multipart/mixed; boundary=outer
+
+--outer
+Content-Type: text/plain
+
+See attached
+--outer
+Content-Type: message/rfc822
+
+`, "\n", "\r\n", -1) + inner.String() + "\r\n--outer--\r\n"
+	}
+
+	exe := "MZ\x90\x00" + strings.Repeat("\x00", 100)
+	bad := forward(Parts{
+		Text{Text: "Pay this"},
+		File{Name: "invoice.pdf.exe", ContentType: "application/pdf", Reader: strings.NewReader(exe)},
+	})
+	good := forward(Parts{File{Name: "invoice.pdf", Reader: strings.NewReader("%PDF-1.4\n")}})
+
+	tests := []struct {
+		name    string
+		policy  *Policy
+		message string
+		want    string
+	}{
+		{"extension", &Policy{DenyExtensions: []string{".exe"}}, bad,
+			`forwarded message contains invoice.pdf.exe: extension ".exe" not allowed`},
+		{"double extension", &Policy{DenyDoubleExtensions: true}, bad,
+			`forwarded message contains invoice.pdf.exe: double extension in "invoice.pdf.exe"`},
+		{"executable", &Policy{DenyExecutables: true}, bad,
+			"forwarded message contains invoice.pdf.exe: executable content"},
+		{"clean", &Policy{DenyExtensions: []string{".exe"}, DenyExecutables: true}, good, ""},
+	}
+
+	for _, test := range tests {
+		verdicts, err := test.policy.Check(strings.NewReader(test.message))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(verdicts) != 2 || verdicts[1].Reason != test.want {
+			t.Errorf("Invalid %s verdicts:\n\tGot:%+v\n\tWant:%q\n", test.name, verdicts, test.want)
+		}
+	}
+
+	// Rewriting replaces the whole forwarded message
+	var out bytes.Buffer
+	_, err := (&Policy{DenyExecutables: true}).Rewrite(strings.NewReader(bad), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "TVqQ") || !strings.Contains(out.String(), "was removed") {
+		t.Errorf("Invalid rewrite:\n\tGot:%q\n", out.String())
+	}
+}
@@ -0,0 +1,227 @@
+package mimestream
+
+import (
+	"io"
+	"sync"
+)
+
+// ProgressKind is the type of a ProgressEvent
+type ProgressKind int
+
+// Progress events, in the order they happen for a part
+const (
+	// ProgressStart before anything of the part is written
+	ProgressStart ProgressKind = iota
+
+	// ProgressRead after every chunk read from the source (File and FormFile)
+	ProgressRead
+
+	// ProgressWrite after every chunk of the encoded body is written
+	ProgressWrite
+
+	// ProgressFinish once the part is complete
+	ProgressFinish
+
+	// ProgressError when the part failed (instead of ProgressFinish)
+	ProgressError
+)
+
+var progressKinds = []string{"start", "read", "write", "finish", "error"}
+
+func (k ProgressKind) String() string {
+	if k < 0 || int(k) >= len(progressKinds) {
+		return "unknown"
+	}
+	return progressKinds[k]
+}
+
+// ProgressEvent reports how far a part is. Nested multiparts have their own
+// events around the events of their parts.
+type ProgressEvent struct {
+	Kind ProgressKind
+
+	// Path of the part (see BoundaryFunc)
+	Path string
+
+	// Name is the filename of File and FormFile parts
+	Name string
+
+	// Read is the number of bytes read from the source so far
+	Read int64
+
+	// Written is the number of encoded body bytes written so far
+	Written int64
+
+	// Size is the number of encoded body bytes the part will have once
+	// finished, or -1 when not known in advance (see Parts.Size)
+	Size int64
+
+	// Err is set for ProgressError
+	Err error
+}
+
+// partProgress tracks a single part. A nil *partProgress reports nothing so
+// parts do not need to check if there is an observer.
+type partProgress struct {
+	fn    func(ProgressEvent)
+	event ProgressEvent
+}
+
+func (p *partProgress) emit(kind ProgressKind, err error) {
+	if p == nil {
+		return
+	}
+	p.event.Kind = kind
+	p.event.Err = err
+	p.fn(p.event)
+}
+
+// reader reports the bytes read from r
+func (p *partProgress) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &progressReader{r: r, p: p}
+}
+
+// writer reports the bytes written to w
+func (p *partProgress) writer(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+	return &progressWriter{w: w, p: p}
+}
+
+type progressReader struct {
+	r io.Reader
+	p *partProgress
+}
+
+func (r *progressReader) Read(b []byte) (n int, err error) {
+	n, err = r.r.Read(b)
+	if n > 0 {
+		r.p.event.Read += int64(n)
+		r.p.emit(ProgressRead, nil)
+	}
+	return
+}
+
+type progressWriter struct {
+	w io.Writer
+	p *partProgress
+}
+
+func (w *progressWriter) Write(b []byte) (n int, err error) {
+	n, err = w.w.Write(b)
+	if n > 0 {
+		w.p.event.Written += int64(n)
+		w.p.emit(ProgressWrite, nil)
+	}
+	return
+}
+
+// progressParts holds the parts being written, by path
+type progressParts struct {
+	mu    sync.Mutex
+	parts map[string]*partProgress
+
+	// sizes of the parts sized so far (-1 when unknown)
+	sizes map[string]int64
+}
+
+// progress of the part at path (nil without a Progress observer)
+func (s *writeState) progress(path string) *partProgress {
+	if s.opts.Progress == nil {
+		return nil
+	}
+
+	s.inProgress.mu.Lock()
+	defer s.inProgress.mu.Unlock()
+	return s.inProgress.parts[path]
+}
+
+// startPart reports ProgressStart for the part at path
+func (s *writeState) startPart(path string, part Part) *partProgress {
+	if s.opts.Progress == nil {
+		return nil
+	}
+
+	p := &partProgress{
+		fn:    s.opts.Progress,
+		event: ProgressEvent{Path: path, Name: partName(part), Size: s.progressSize(path, part)},
+	}
+
+	s.inProgress.mu.Lock()
+	if s.inProgress.parts == nil {
+		s.inProgress.parts = map[string]*partProgress{}
+	}
+	s.inProgress.parts[path] = p
+	s.inProgress.mu.Unlock()
+
+	p.emit(ProgressStart, nil)
+	return p
+}
+
+// progressSize of the part at path, -1 when unknown. Sizing a multipart
+// records the sizes of all its parts (see recordSize), so nested parts are not
+// sized again.
+func (s *writeState) progressSize(path string, part Part) int64 {
+	s.inProgress.mu.Lock()
+	size, ok := s.inProgress.sizes[path]
+	s.inProgress.mu.Unlock()
+	if ok {
+		return size
+	}
+
+	size = -1
+	if sz, ok := part.(sizer); ok {
+		if header, n, err := sz.partSize(s, path); err == nil && header != nil {
+			size = n
+		}
+	}
+	s.recordSize(path, size)
+	return size
+}
+
+// recordSize of the part at path for its ProgressStart (only with a Progress
+// observer)
+func (s *writeState) recordSize(path string, size int64) {
+	if s.opts.Progress == nil {
+		return
+	}
+
+	s.inProgress.mu.Lock()
+	if s.inProgress.sizes == nil {
+		s.inProgress.sizes = map[string]int64{}
+	}
+	s.inProgress.sizes[path] = size
+	s.inProgress.mu.Unlock()
+}
+
+// finishPart reports ProgressFinish or ProgressError
+func (s *writeState) finishPart(p *partProgress, err error) {
+	if p == nil {
+		return
+	}
+
+	s.inProgress.mu.Lock()
+	delete(s.inProgress.parts, p.event.Path)
+	s.inProgress.mu.Unlock()
+
+	if err != nil {
+		p.emit(ProgressError, err)
+		return
+	}
+	p.emit(ProgressFinish, nil)
+}
+
+// partName is the filename of the part (if any)
+func partName(part Part) string {
+	switch p := part.(type) {
+	case File:
+		return p.Name
+	case FormFile:
+		return p.Name
+	}
+	return ""
+}
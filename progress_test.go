@@ -0,0 +1,113 @@
+package mimestream
+
+import (
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestProgress(t *testing.T) {
+	content := strings.Repeat("0123456789", 10000)
+
+	var events []ProgressEvent
+	wr := &Writer{Progress: func(e ProgressEvent) {
+		events = append(events, e)
+	}}
+
+	parts := Parts{
+		Text{Text: "Hello"},
+		File{Name: "file.txt", Reader: strings.NewReader(content)},
+		Mixed{Parts: Parts{
+			File{Name: "nested.txt", Reader: strings.NewReader(content)},
+		}},
+		File{Name: "broken.txt", Reader: &failingReader{n: 100}},
+	}
+
+	err := wr.Into(multipart.NewWriter(ioutil.Discard), parts)
+	if err == nil {
+		t.Fatal("Failing reader accepted")
+	}
+
+	last := map[string]ProgressEvent{}
+	for _, e := range events {
+		prev, started := last[e.Path]
+		if !started && e.Kind != ProgressStart {
+			t.Errorf("Event before ProgressStart: %+v", e)
+		}
+		if started && (e.Read < prev.Read || e.Written < prev.Written) {
+			t.Errorf("Progress went backwards: %+v after %+v", e, prev)
+		}
+		last[e.Path] = e
+	}
+
+	want := map[string]struct {
+		kind ProgressKind
+		name string
+		read int64
+	}{
+		"1":   {ProgressFinish, "", 0},
+		"2":   {ProgressFinish, "file.txt", int64(len(content))},
+		"3":   {ProgressFinish, "", 0},
+		"3.1": {ProgressFinish, "nested.txt", int64(len(content))},
+		"4":   {ProgressError, "broken.txt", 100},
+	}
+
+	for path, w := range want {
+		e := last[path]
+		if e.Kind != w.kind || e.Name != w.name || e.Read != w.read {
+			t.Errorf("Invalid last event for %q:\n\tGot:%v %q %d\n\tWant:%v %q %d\n", path, e.Kind, e.Name, e.Read, w.kind, w.name, w.read)
+		}
+		if e.Kind == ProgressFinish && e.Written != e.Size {
+			t.Errorf("Invalid bytes written for %q:\n\tGot:%d\n\tWant:%d\n", path, e.Written, e.Size)
+		}
+	}
+
+	if last["4"].Err == nil || last["4"].Size != -1 {
+		t.Errorf("Invalid error event: %+v", last["4"])
+	}
+}
+
+// sizeCounter is a Text counting how many times it is sized
+type sizeCounter struct {
+	Text
+	calls *int
+}
+
+func (c sizeCounter) partSize(s *writeState, path string) (textproto.MIMEHeader, int64, error) {
+	*c.calls++
+	return c.Text.partSize(s, path)
+}
+
+func TestProgressSizesOnce(t *testing.T) {
+	var top, nested int
+	var sizes []int64
+	wr := &Writer{Progress: func(e ProgressEvent) {
+		if e.Kind == ProgressStart {
+			sizes = append(sizes, e.Size)
+		}
+	}}
+
+	parts := Parts{
+		sizeCounter{Text: Text{Text: "Top"}, calls: &top},
+		Mixed{Parts: Parts{Mixed{Parts: Parts{Mixed{Parts: Parts{
+			sizeCounter{Text: Text{Text: "Nested"}, calls: &nested},
+		}}}}}},
+	}
+
+	err := wr.Into(multipart.NewWriter(ioutil.Discard), parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if top != 1 || nested != 1 {
+		t.Errorf("Invalid number of sizings:\n\tGot:%d %d\n\tWant:%d %d\n", top, nested, 1, 1)
+	}
+	for _, size := range sizes {
+		if size < 0 {
+			t.Errorf("Invalid sizes:\n\tGot:%v\n", sizes)
+			break
+		}
+	}
+}
@@ -2,10 +2,12 @@ package mimestream
 
 import (
 	"bufio"
+	"context"
 	"encoding/base64"
 	"io"
 	"mime"
 	"mime/multipart"
+	"mime/quotedprintable"
 	"net/textproto"
 	"strings"
 
@@ -28,10 +30,70 @@ var ErrMissingBoundary = errors.New("Missing boundary")
 // The format of the callback for handling MIME emails
 type partHandler func(textproto.MIMEHeader, io.Reader) error
 
+// Parser walks MIME entities with optional extra processing. The zero value
+// behaves exactly like HandleEmailFromReader.
+type Parser struct {
+	// Verifier checks multipart/signed bodies. When nil, signed bodies are
+	// walked like any other multipart.
+	Verifier SignatureVerifier
+
+	// SignatureHandler is called with the result of verifying each
+	// multipart/signed body, before the leaves of the signed content.
+	SignatureHandler func(SignatureStatus) error
+
+	// Workers runs the handler for up to Workers leaf parts at the same time
+	// (optional). Each body is spooled first (memory up to SpoolMemory, which
+	// defaults to DefaultSpoolMemory, then temp files in SpoolDir) so the
+	// parser can move on. Every leaf is handled even after a handler fails;
+	// the first error in part order is returned.
+	Workers     int
+	SpoolMemory int64
+	SpoolDir    string
+
+	// Sanitizer cleans the body of every text/html leaf before the handler
+	// reads it (optional). The header is left as it is.
+	Sanitizer *Sanitizer
+
+	// Report is called once parsing is done with the result of every leaf
+	// handled, in part order (optional)
+	Report func([]PartResult)
+}
+
 // NewEmailFromReader reads a stream of bytes from an io.Reader, r,
 // and returns an email struct containing the parsed data.
 // This function expects the data in RFC 5322 format.
 func HandleEmailFromReader(r io.Reader, h partHandler) (err error) {
+	return (&Parser{}).HandleEmailFromReader(r, h)
+}
+
+// HandleEmailFromReaderContext is HandleEmailFromReader stopping as soon as
+// ctx is done (see Parser.HandleEmailFromReaderContext)
+func HandleEmailFromReaderContext(ctx context.Context, r io.Reader, h partHandler) (err error) {
+	return (&Parser{}).HandleEmailFromReaderContext(ctx, r, h)
+}
+
+// HandleEmailFromReader works like the package level HandleEmailFromReader
+// while applying the Parser options.
+func (ps *Parser) HandleEmailFromReader(r io.Reader, h partHandler) (err error) {
+	return ps.HandleEmailFromReaderContext(context.Background(), r, h)
+}
+
+// HandleEmailFromReaderContext checks ctx before every read from r, so the
+// handlers see the cancellation as a read error. A read blocked on an r with
+// deadlines (like a net.Conn) is interrupted as well. Returns ctx.Err() once
+// ctx is done.
+func (ps *Parser) HandleEmailFromReaderContext(ctx context.Context, r io.Reader, h partHandler) (err error) {
+	if ctx.Done() != nil {
+		defer interruptRead(ctx, r)()
+		r = &contextReader{ctx: ctx, r: r}
+
+		defer func() {
+			if err != nil && ctx.Err() != nil {
+				err = ctx.Err()
+			}
+		}()
+	}
+
 	tp := textproto.NewReader(bufioReader(r))
 
 	var header textproto.MIMEHeader
@@ -46,26 +108,27 @@ func HandleEmailFromReader(r io.Reader, h partHandler) (err error) {
 	// (*map[string][]string).(header)
 
 	// Recursively parse the MIME parts
-	err = parseMIMEParts(header, tp.R, h, 0)
+	st := ps.newParseState()
+	err = st.finish(ps.parseMIMEParts(st, "", header, tp.R, h, 0))
 	return
 }
 
 // parseMIMEParts will recursively walk a MIME entity calling the handler
-func parseMIMEParts(hs textproto.MIMEHeader, body io.Reader, handler partHandler, level int) (err error) {
+func (ps *Parser) parseMIMEParts(st *parseState, path string, hs textproto.MIMEHeader, body io.Reader, handler partHandler, level int) (err error) {
 
 	// Protect against bad actors
 	if level > MaximumMultipartDepth {
 		return ErrMaximumMultipartDepth
 	}
 
-	ct, params, err := mime.ParseMediaType(hs.Get("Content-Type"))
+	ct, params, err := parseContentType(hs)
 	if err != nil {
 		return
 	}
 
 	// Either a leaf node, or not a multipart email
 	if !strings.HasPrefix(ct, "multipart/") {
-		err = handler(hs, contentDecoderReader(hs, body))
+		err = st.leaf(path, hs, contentDecoderReader(hs, body), handler)
 		return
 	}
 
@@ -74,6 +137,10 @@ func parseMIMEParts(hs textproto.MIMEHeader, body io.Reader, handler partHandler
 		return ErrMissingBoundary
 	}
 
+	if ct == "multipart/signed" && ps.Verifier != nil {
+		return ps.parseSigned(st, path, params, body, handler, level)
+	}
+
 	// Readers are buffered https://golang.org/src/mime/multipart/multipart.go#L99
 	mr := multipart.NewReader(body, params["boundary"])
 
@@ -103,18 +170,18 @@ func parseMIMEParts(hs textproto.MIMEHeader, body io.Reader, handler partHandler
 		body := contentDecoderReader(p.Header, p)
 
 		var subct string
-		subct, _, err = mime.ParseMediaType(p.Header.Get("Content-Type"))
+		subct, _, err = parseContentType(p.Header)
 
 		// Nested multipart
 		if strings.HasPrefix(subct, "multipart/") {
-			err = parseMIMEParts(p.Header, body, handler, level+1)
+			err = ps.parseMIMEParts(st, childPath(path, partsCounter-1), p.Header, body, handler, level+1)
 			if err != nil {
 				return
 			}
 
 		} else {
 			// Leaf node
-			err = handler(p.Header, body)
+			err = st.leaf(childPath(path, partsCounter-1), p.Header, body, handler)
 			if err != nil {
 				return
 			}
@@ -124,13 +191,26 @@ func parseMIMEParts(hs textproto.MIMEHeader, body io.Reader, handler partHandler
 	return
 }
 
+// parseContentType of an entity. Without a Content-Type it is plain US-ASCII
+// text (RFC 2045 section 5.2).
+func parseContentType(header textproto.MIMEHeader) (string, map[string]string, error) {
+	contentType := header.Get("Content-Type")
+	if strings.TrimSpace(contentType) == "" {
+		return "text/plain", map[string]string{"charset": "us-ascii"}, nil
+	}
+	return mime.ParseMediaType(contentType)
+}
+
 // contentDecoderReader
 func contentDecoderReader(headers textproto.MIMEHeader, bodyReader io.Reader) *bufio.Reader {
-	// Already handled by textproto
-	// if headers.Get("Content-Transfer-Encoding") == "quoted-printable" {
-	// 	return bufioReader(quotedprintable.NewReader(bodyReader))
-	// }
-	if headers.Get("Content-Transfer-Encoding") == "base64" {
+	// Already handled by mime/multipart for parts (which also removes the
+	// header) but not for entities we read ourselves, like the top level body.
+	// Encodings are case-insensitive (RFC 2045).
+	encoding := strings.TrimSpace(headers.Get("Content-Transfer-Encoding"))
+	if strings.EqualFold(encoding, "quoted-printable") {
+		return bufioReader(quotedprintable.NewReader(bodyReader))
+	}
+	if strings.EqualFold(encoding, "base64") {
 		return bufioReader(base64.NewDecoder(base64.StdEncoding, bodyReader))
 	}
 	return bufioReader(bodyReader)
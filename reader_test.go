@@ -126,3 +126,32 @@ func TestReader(t *testing.T) {
 		t.Errorf("Invalid number of parts found:\n\tGot:%d\n\tWant:%d\n", partCounter, want)
 	}
 }
+
+func TestReaderTopLevelEncoding(t *testing.T) {
+	tests := []struct {
+		encoding string
+		body     string
+	}{
+		{"Quoted-Printable", "Caf=C3=A9"},
+		{"quoted-printable", "Caf=C3=A9"},
+		{"BASE64", "Q2Fmw6k="},
+	}
+
+	for _, test := range tests {
+		message := "Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: " + test.encoding + "\r\n\r\n" + test.body
+
+		var got string
+		err := HandleEmailFromReader(strings.NewReader(message), func(header textproto.MIMEHeader, body io.Reader) error {
+			b, err := ioutil.ReadAll(body)
+			got = string(b)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != "Café" {
+			t.Errorf("Invalid %s body:\n\tGot:%q\n\tWant:%q\n", test.encoding, got, "Café")
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package mimestream
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
+// partOutput is what a rewriter writes in place of a part: a header and a
+// function writing the (already encoded) body, or a Part. The zero partOutput
+// drops the part.
+type partOutput struct {
+	header textproto.MIMEHeader
+	write  func(w io.Writer) error
+	part   Part
+
+	// descend into a multipart, writing it with header
+	descend bool
+}
+
+// rewriter decides what happens to every part of a message being copied
+type rewriter interface {
+	// leaf is given the header and raw (still transfer encoded) body
+	leaf(path string, header textproto.MIMEHeader, raw io.Reader) (partOutput, error)
+
+	// multipart may descend (with a new header), replace or drop a multipart
+	multipart(path string, header textproto.MIMEHeader) (partOutput, error)
+}
+
+// rewriteMessage copies the message from r to w through rw, keeping the
+// multipart structure. Multiparts get new boundaries from s. The limits of
+// the reader apply.
+func rewriteMessage(s *writeState, r io.Reader, w io.Writer, rw rewriter) (err error) {
+	tp := textproto.NewReader(bufioReader(r))
+
+	var header textproto.MIMEHeader
+	var order []string
+	header, order, err = readHeader(tp)
+	if err != nil {
+		return
+	}
+
+	ct, params, err := parseContentType(header)
+	if err != nil {
+		return
+	}
+
+	var out partOutput
+	if !strings.HasPrefix(ct, "multipart/") {
+		out, err = rw.leaf("", header, tp.R)
+		if err != nil {
+			return
+		}
+		if out.write == nil || out.header == nil {
+			return ErrInvalidDecision
+		}
+
+		err = writeHeaderOrder(w, out.header, order)
+		if err != nil {
+			return
+		}
+		return out.write(w)
+	}
+
+	if _, ok := params["boundary"]; !ok {
+		return ErrMissingBoundary
+	}
+
+	out, err = rw.multipart("", header)
+	if err != nil {
+		return
+	}
+	if !out.descend {
+		return ErrInvalidDecision
+	}
+
+	boundary := s.boundary("")
+	err = writeHeaderOrder(w, withBoundary(out.header, boundary), order)
+	if err != nil {
+		return
+	}
+
+	mw := multipart.NewWriter(w)
+	err = mw.SetBoundary(boundary)
+	if err != nil {
+		return
+	}
+
+	err = s.rewriteParts(mw, "", tp.R, params["boundary"], rw, 0)
+	if err != nil {
+		return
+	}
+	return mw.Close()
+}
+
+// rewriteParts copies the parts of a multipart body to mw
+func (s *writeState) rewriteParts(mw *multipart.Writer, path string, body io.Reader, boundary string, rw rewriter, level int) (err error) {
+
+	// Protect against bad actors
+	if level > MaximumMultipartDepth {
+		return ErrMaximumMultipartDepth
+	}
+
+	mr := multipart.NewReader(body, boundary)
+
+	var partsCounter int
+	var p *multipart.Part
+	for {
+		err = s.ctx.Err()
+		if err != nil {
+			return
+		}
+
+		// Raw parts keep their quoted-printable encoding and header
+		p, err = mr.NextRawPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return
+		}
+
+		// Protect against bad actors
+		partsCounter++
+		if partsCounter > MaximumPartsPerMultipart {
+			return ErrMaximumPartsPerMultipart
+		}
+
+		child := childPath(path, partsCounter-1)
+
+		var out partOutput
+		ct, params, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		_, hasBoundary := params["boundary"]
+		nested := hasBoundary && strings.HasPrefix(ct, "multipart/")
+
+		if nested {
+			out, err = rw.multipart(child, p.Header)
+		} else {
+			out, err = rw.leaf(child, p.Header, p)
+		}
+		if err != nil {
+			return
+		}
+
+		switch {
+		case out.descend && nested:
+			err = s.rewriteNested(mw, child, out.header, p, params["boundary"], rw, level+1)
+
+		case out.part != nil:
+			if sa, ok := out.part.(stateAdder); ok {
+				err = sa.add(s, child, mw)
+			} else {
+				err = out.part.Add(mw)
+			}
+
+		case out.header != nil && out.write != nil:
+			var part io.Writer
+			part, err = mw.CreatePart(foldHeader(out.header))
+			if err == nil {
+				err = out.write(part)
+			}
+
+		case out.descend || out.header != nil:
+			err = ErrInvalidDecision
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// rewriteNested writes a multipart with a new boundary and copies its parts
+func (s *writeState) rewriteNested(mw *multipart.Writer, path string, header textproto.MIMEHeader, body io.Reader, boundary string, rw rewriter, level int) (err error) {
+	newBoundary := s.boundary(path)
+
+	var part io.Writer
+	part, err = mw.CreatePart(foldHeader(withBoundary(header, newBoundary)))
+	if err != nil {
+		return
+	}
+
+	nested := multipart.NewWriter(part)
+	err = nested.SetBoundary(newBoundary)
+	if err != nil {
+		return
+	}
+
+	err = s.rewriteParts(nested, path, body, boundary, rw, level)
+	if err != nil {
+		return
+	}
+	return nested.Close()
+}
+
+// withBoundary returns a copy of the header with the boundary replaced
+func withBoundary(header textproto.MIMEHeader, boundary string) textproto.MIMEHeader {
+	ct, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if params == nil {
+		params = map[string]string{}
+	}
+	params["boundary"] = boundary
+
+	copied := textproto.MIMEHeader{}
+	for k, v := range header {
+		copied[k] = v
+	}
+	copied.Set("Content-Type", mime.FormatMediaType(ct, params))
+	return copied
+}
+
+// readHeader is textproto.Reader.ReadMIMEHeader also returning the key of
+// every line, so the message header (Received, DKIM-Signature...) is written
+// back in its order
+func readHeader(tp *textproto.Reader) (header textproto.MIMEHeader, order []string, err error) {
+	header = textproto.MIMEHeader{}
+	for {
+		var line string
+		line, err = tp.ReadContinuedLine()
+		if line == "" || err != nil {
+			return
+		}
+
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return header, order, textproto.ProtocolError("malformed MIME header line: " + line)
+		}
+
+		key := textproto.CanonicalMIMEHeaderKey(strings.TrimRight(line[:i], " \t"))
+		header[key] = append(header[key], strings.TrimLeft(line[i+1:], " \t"))
+		order = append(order, key)
+	}
+}
+
+// foldHeader returns a copy of the header with long values folded (see
+// foldHeaderLine), as multipart.Writer writes them unchanged
+func foldHeader(header textproto.MIMEHeader) textproto.MIMEHeader {
+	folded := textproto.MIMEHeader{}
+	for k, vv := range header {
+		for _, v := range vv {
+			folded[k] = append(folded[k], foldHeaderLine(k, v)[len(k)+2:])
+		}
+	}
+	return folded
+}
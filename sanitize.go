@@ -0,0 +1,346 @@
+package mimestream
+
+import (
+	"io"
+	"mime"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Sanitizer makes HTML bodies safe to show in a browser. Only formatting
+// elements and attributes are kept: scripts, event handlers, forms, frames,
+// embedded objects and dangerous CSS are removed. The zero value keeps remote
+// images; set Parser.Sanitizer to sanitize every text/html leaf.
+type Sanitizer struct {
+	// BlockRemoteImages removes http(s) images and CSS urls, which are often
+	// used to track when a message is opened. cid: and data: images are kept.
+	BlockRemoteImages bool
+
+	// RedirectLink rewrites the http(s) links (optional), for example to go
+	// through a redirector. Returning "" removes the link.
+	RedirectLink func(href string) string
+}
+
+// sanitizeDrop elements are removed along with their content
+var sanitizeDrop = map[atom.Atom]bool{
+	atom.Script: true, atom.Noscript: true, atom.Template: true,
+	atom.Iframe: true, atom.Frame: true, atom.Frameset: true, atom.Noframes: true,
+	atom.Object: true, atom.Embed: true, atom.Applet: true, atom.Param: true,
+	atom.Svg: true, atom.Math: true, atom.Title: true,
+	atom.Select: true, atom.Textarea: true, atom.Input: true,
+	atom.Base: true, atom.Meta: true, atom.Link: true,
+	atom.Audio: true, atom.Video: true, atom.Source: true, atom.Track: true,
+}
+
+// sanitizeElements are kept, everything else is removed keeping its content
+var sanitizeElements = map[atom.Atom]bool{
+	atom.Html: true, atom.Head: true, atom.Body: true, atom.Style: true,
+	atom.A: true, atom.Abbr: true, atom.Address: true, atom.Article: true,
+	atom.Aside: true, atom.B: true, atom.Bdi: true, atom.Bdo: true,
+	atom.Big: true, atom.Blockquote: true, atom.Br: true, atom.Caption: true,
+	atom.Center: true, atom.Cite: true, atom.Code: true, atom.Col: true,
+	atom.Colgroup: true, atom.Dd: true, atom.Del: true, atom.Details: true,
+	atom.Dfn: true, atom.Div: true, atom.Dl: true, atom.Dt: true,
+	atom.Em: true, atom.Figcaption: true, atom.Figure: true, atom.Font: true,
+	atom.Footer: true, atom.H1: true, atom.H2: true, atom.H3: true,
+	atom.H4: true, atom.H5: true, atom.H6: true, atom.Header: true,
+	atom.Hr: true, atom.I: true, atom.Img: true, atom.Ins: true,
+	atom.Kbd: true, atom.Li: true, atom.Main: true, atom.Mark: true,
+	atom.Nav: true, atom.Ol: true, atom.P: true, atom.Pre: true,
+	atom.Q: true, atom.S: true, atom.Samp: true, atom.Section: true,
+	atom.Small: true, atom.Span: true, atom.Strike: true, atom.Strong: true,
+	atom.Sub: true, atom.Summary: true, atom.Sup: true, atom.Table: true,
+	atom.Tbody: true, atom.Td: true, atom.Tfoot: true, atom.Th: true,
+	atom.Thead: true, atom.Time: true, atom.Tr: true, atom.Tt: true,
+	atom.U: true, atom.Ul: true, atom.Var: true, atom.Wbr: true,
+}
+
+// sanitizeAttributes are kept on every element (URLs and style are checked)
+var sanitizeAttributes = map[string]bool{
+	"align": true, "alt": true, "bgcolor": true, "border": true,
+	"cellpadding": true, "cellspacing": true, "class": true, "color": true,
+	"cols": true, "colspan": true, "dir": true, "face": true,
+	"height": true, "hspace": true, "lang": true, "nowrap": true,
+	"rows": true, "rowspan": true, "size": true, "span": true,
+	"start": true, "summary": true, "title": true, "type": true,
+	"valign": true, "vspace": true, "width": true,
+}
+
+// rawTextElements make the tokenizer (and browsers) read the following text
+// up to their end tag as their content, even when written self-closing
+var rawTextElements = map[atom.Atom]bool{
+	atom.Iframe: true, atom.Noembed: true, atom.Noframes: true, atom.Noscript: true,
+	atom.Plaintext: true, atom.Script: true, atom.Style: true, atom.Textarea: true,
+	atom.Title: true, atom.Xmp: true,
+}
+
+// voidElements have no end tag
+var voidElements = map[atom.Atom]bool{
+	atom.Area: true, atom.Base: true, atom.Br: true, atom.Col: true,
+	atom.Embed: true, atom.Hr: true, atom.Img: true, atom.Input: true,
+	atom.Link: true, atom.Meta: true, atom.Param: true, atom.Source: true,
+	atom.Track: true, atom.Wbr: true,
+}
+
+// Sanitize streams the HTML from r to w keeping only the safe parts
+func (sz *Sanitizer) Sanitize(w io.Writer, r io.Reader) (err error) {
+	z := html.NewTokenizer(r)
+
+	// The element being dropped with its content, and how deep we are in it
+	var drop atom.Atom
+	var depth int
+	var style bool
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() == io.EOF {
+				return nil
+			}
+			return z.Err()
+		}
+
+		var out string
+		t := z.Token()
+
+		if depth > 0 {
+			if t.DataAtom == drop && t.DataAtom != 0 {
+				switch tt {
+				case html.StartTagToken:
+					depth++
+				case html.EndTagToken:
+					depth--
+				}
+			}
+			continue
+		}
+
+		switch tt {
+		case html.TextToken:
+			if style {
+				out = sz.css(t.Data)
+			} else {
+				out = html.EscapeString(t.Data)
+			}
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			// <style/> still opens a style block
+			if rawTextElements[t.DataAtom] {
+				tt, t.Type = html.StartTagToken, html.StartTagToken
+			}
+
+			if sanitizeDrop[t.DataAtom] {
+				if tt == html.StartTagToken && !voidElements[t.DataAtom] {
+					drop, depth = t.DataAtom, 1
+				}
+				continue
+			}
+			if !sanitizeElements[t.DataAtom] {
+				continue
+			}
+
+			style = tt == html.StartTagToken && t.DataAtom == atom.Style
+			t.Attr = sz.attributes(t.DataAtom, t.Attr)
+			out = t.String()
+
+		case html.EndTagToken:
+			if t.DataAtom == atom.Style {
+				style = false
+			}
+			if !sanitizeElements[t.DataAtom] {
+				continue
+			}
+			out = t.String()
+
+		default:
+			// Comments (including conditional comments) and doctypes
+			continue
+		}
+
+		_, err = io.WriteString(w, out)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// SanitizeString is Sanitize for an HTML string
+func (sz *Sanitizer) SanitizeString(s string) (string, error) {
+	var buf strings.Builder
+	err := sz.Sanitize(&buf, strings.NewReader(s))
+	return buf.String(), err
+}
+
+// attributes of the element that are safe to keep
+func (sz *Sanitizer) attributes(a atom.Atom, attrs []html.Attribute) (safe []html.Attribute) {
+	for _, attr := range attrs {
+		if attr.Namespace != "" {
+			continue
+		}
+
+		switch {
+		case sanitizeAttributes[attr.Key]:
+
+		case attr.Key == "style":
+			attr.Val = sz.css(attr.Val)
+
+		case attr.Key == "href" && a == atom.A:
+			attr.Val = sz.link(attr.Val)
+			if attr.Val == "" {
+				continue
+			}
+
+		case attr.Key == "src" && a == atom.Img, attr.Key == "background":
+			if !sz.image(attr.Val) {
+				continue
+			}
+
+		default:
+			continue
+		}
+
+		safe = append(safe, attr)
+	}
+
+	if a == atom.A {
+		safe = append(safe, html.Attribute{Key: "rel", Val: "noopener noreferrer"})
+	}
+	return
+}
+
+// link is the href to keep ("" to remove it)
+func (sz *Sanitizer) link(href string) string {
+	href = strings.TrimSpace(href)
+	scheme := urlScheme(href)
+
+	switch scheme {
+	case "http", "https":
+		if sz.RedirectLink != nil {
+			return sz.RedirectLink(href)
+		}
+		return href
+	case "mailto", "tel", "cid":
+		return href
+	case "":
+		// Only anchors, a relative link has nothing to point to
+		if strings.HasPrefix(href, "#") {
+			return href
+		}
+	}
+	return ""
+}
+
+// safeImageTypes are the data: images kept (SVG can contain scripts)
+var safeImageTypes = []string{"image/png", "image/gif", "image/jpeg", "image/webp", "image/bmp"}
+
+// image reports if the image URL can be loaded
+func (sz *Sanitizer) image(src string) bool {
+	src = strings.TrimSpace(src)
+
+	switch urlScheme(src) {
+	case "cid":
+		return true
+	case "http", "https":
+		return !sz.BlockRemoteImages
+	case "data":
+		mediaType := strings.ToLower(src[strings.Index(src, ":")+1:])
+		if i := strings.IndexAny(mediaType, ";,"); i >= 0 {
+			mediaType = mediaType[:i]
+		}
+		return contains(safeImageTypes, mediaType)
+	}
+	return false
+}
+
+// urlScheme in lower case ("" for relative URLs)
+func urlScheme(u string) string {
+	i := strings.Index(u, ":")
+	if i < 0 {
+		return ""
+	}
+
+	// Browsers ignore tabs and new lines, java\tscript: is javascript:
+	scheme := strings.ToLower(strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, u[:i]))
+
+	if strings.ContainsAny(scheme, "/?#") {
+		return ""
+	}
+	return scheme
+}
+
+var (
+	cssComment = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	cssChunk   = regexp.MustCompile(`[^;{}]*[;{}]?`)
+	cssURLs    = regexp.MustCompile(`(?i)url\(\s*['"]?([^'")]*)['"]?\s*\)`)
+)
+
+// cssDangerous can run code, load other style sheets or hide escapes
+var cssDangerous = []string{"expression", "javascript:", "vbscript:", "behavior", "-moz-binding", "@import", "\\", "<", "&#"}
+
+// css with every declaration (or rule) that is not safe removed
+func (sz *Sanitizer) css(s string) string {
+	s = cssComment.ReplaceAllString(s, " ")
+
+	var buf strings.Builder
+	for _, chunk := range cssChunk.FindAllString(s, -1) {
+		if sz.cssSafe(chunk) {
+			buf.WriteString(chunk)
+		} else if end := chunk[len(chunk)-1]; end == '{' || end == '}' {
+			// Keep the rules balanced
+			buf.WriteByte(end)
+		}
+	}
+	return buf.String()
+}
+
+func (sz *Sanitizer) cssSafe(chunk string) bool {
+	lower := strings.ToLower(chunk)
+	for _, d := range cssDangerous {
+		if strings.Contains(lower, d) {
+			return false
+		}
+	}
+
+	for _, m := range cssURLs.FindAllStringSubmatch(chunk, -1) {
+		if !sz.image(m[1]) {
+			return false
+		}
+	}
+
+	// Anything like url( the pattern could not read
+	return len(cssURLs.FindAllString(lower, -1)) == strings.Count(lower, "url(")
+}
+
+// handler passes the sanitized body of text/html parts to h
+func (sz *Sanitizer) handler(h partHandler) partHandler {
+	return func(header textproto.MIMEHeader, body io.Reader) error {
+		ct, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+		if ct != "text/html" {
+			return h(header, body)
+		}
+
+		pr, pw := io.Pipe()
+		done := make(chan struct{})
+
+		go func() {
+			defer close(done)
+			pw.CloseWithError(sz.Sanitize(pw, body))
+		}()
+
+		err := h(header, pr)
+
+		// Stop the sanitizer before the parser reads on
+		pr.Close()
+		<-done
+		return err
+	}
+}
@@ -0,0 +1,100 @@
+package mimestream
+
+import (
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name string
+		sz   *Sanitizer
+		html string
+		want string
+	}{
+		{"script", &Sanitizer{},
+			`<p onclick="steal()">Hi<script>alert(1)</script><!-- note --></p>`,
+			`<p>Hi</p>`},
+		{"links", &Sanitizer{},
+			`<a href="java	script:alert(1)">x</a><a href="https://example.com/" target="_top">y</a>`,
+			`<a rel="noopener noreferrer">x</a><a href="https://example.com/" rel="noopener noreferrer">y</a>`},
+		{"forms", &Sanitizer{},
+			`<form action="https://evil.example"><input name="password"><button>Send</button><select><option>a</option></select></form>`,
+			`Send`},
+		{"frames", &Sanitizer{},
+			`<iframe src="https://evil.example"><p>inside</p></iframe><object><object></object>x</object><b>kept</b>`,
+			`<b>kept</b>`},
+		{"images", &Sanitizer{},
+			`<img src="https://example.com/a.png"><img src="cid:logo"><img src="data:image/svg+xml;base64,PHN2Zz4="><img src="data:image/png;base64,iVBORw0KGgo=">`,
+			`<img src="https://example.com/a.png"><img src="cid:logo"><img><img src="data:image/png;base64,iVBORw0KGgo=">`},
+		{"css", &Sanitizer{},
+			`<style>@import url(x.css); p { color: red; width: expression(alert(1)) } </style><div style="color:red;background:url(javascript:alert(1));x:\65xpression(1)">a</div>`,
+			`<style> p { color: red;} </style><div style="color:red;">a</div>`},
+		{"self-closing", &Sanitizer{BlockRemoteImages: true},
+			`<style/>@import url(https://evil.example/x.css); body{background:url(https://t.example/p.gif)}</style>` +
+				`<script/><img src=x onerror=alert(1)></script><title/>Title</title><textarea/>Text</textarea><xmp/><b>x</b></xmp>`,
+			`<style> body{}</style>&lt;b&gt;x&lt;/b&gt;`},
+		{"remote", &Sanitizer{BlockRemoteImages: true, RedirectLink: func(href string) string {
+			return "https://r.example/?u=" + url.QueryEscape(href)
+		}},
+			`<table background="http://t.example/bg.gif"><tr><td style="background:url('https://t.example/p.gif');color:blue"><img src="https://t.example/p.gif" alt="pixel"><a href="https://example.com/?a=1&amp;b=2">go</a></td></tr></table>`,
+			`<table><tr><td style="color:blue"><img alt="pixel"><a href="https://r.example/?u=https%3A%2F%2Fexample.com%2F%3Fa%3D1%26b%3D2" rel="noopener noreferrer">go</a></td></tr></table>`},
+	}
+
+	for _, test := range tests {
+		got, err := test.sz.SanitizeString(test.html)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("Invalid %s html:\n\tGot:%q\n\tWant:%q\n", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParserSanitizer(t *testing.T) {
+	message := strings.Replace(`Content-Type: multipart/alternative; boundary=alt
+
+--alt
+Content-Type: text/plain
+
+<script>plain text is left alone</script>
+--alt
+Content-Type: text/html
+Content-Transfer-Encoding: quoted-printable
+
+<p>Hello<script>alert(1)</script></p>
+--alt--
+`, "\n", "\r\n", -1)
+
+	for _, workers := range []int{0, 2} {
+		var mu sync.Mutex
+		bodies := map[string]string{}
+
+		ps := &Parser{Sanitizer: &Sanitizer{}, Workers: workers}
+		err := ps.HandleEmailFromReader(strings.NewReader(message), func(header textproto.MIMEHeader, body io.Reader) error {
+			b, err := ioutil.ReadAll(body)
+			mu.Lock()
+			bodies[header.Get("Content-Type")] = string(b)
+			mu.Unlock()
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]string{
+			"text/plain": "<script>plain text is left alone</script>",
+			"text/html":  "<p>Hello</p>",
+		}
+		if !reflect.DeepEqual(bodies, want) {
+			t.Errorf("Invalid bodies with %d workers:\n\tGot:%q\n\tWant:%q\n", workers, bodies, want)
+		}
+	}
+}
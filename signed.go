@@ -0,0 +1,193 @@
+package mimestream
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Signed content has to be held in memory until the signature that follows it
+// has been read
+var MaximumSignedSize int64 = 1024 * 1024 * 25
+
+var ErrMaximumSignedSize = errors.New("Mimestream: Maximum multipart/signed content size reached")
+
+// ErrMalformedSigned for multipart/signed bodies without exactly a signed part
+// followed by a signature part
+var ErrMalformedSigned = errors.New("Mimestream: Malformed multipart/signed body")
+
+// SignatureVerifier checks multipart/signed bodies (RFC 1847). Implementations
+// wrap an S/MIME (application/pkcs7-signature) or PGP
+// (application/pgp-signature) library.
+type SignatureVerifier interface {
+	// Verify is given the protocol and micalg Content-Type parameters, the
+	// exact bytes of the signed entity (headers included, CRLF line endings)
+	// and the decoded body of the signature part.
+	Verify(protocol, micalg string, signed []byte, signature io.Reader) error
+}
+
+// SignatureStatus is the outcome of verifying a multipart/signed body
+type SignatureStatus struct {
+	Protocol string
+	Micalg   string
+
+	// Header of the signature part
+	Header textproto.MIMEHeader
+
+	// Err is nil when the signature was verified
+	Err error
+}
+
+// Verified reports if the signature is valid
+func (s SignatureStatus) Verified() bool {
+	return s.Err == nil
+}
+
+// parseSigned captures the signed entity of a multipart/signed body, verifies
+// it against the signature part and then walks the signed entity
+func (ps *Parser) parseSigned(st *parseState, path string, params map[string]string, body io.Reader, handler partHandler, level int) (err error) {
+	br := bufioReader(body)
+	delimiter := []byte("--" + params["boundary"])
+	budget := MaximumSignedSize
+
+	// Skip the preamble
+	var line []byte
+	for {
+		line, err = readLine(br, budget)
+		budget -= int64(len(line))
+		if err == io.EOF {
+			return ErrMalformedSigned
+		}
+		if err != nil {
+			return
+		}
+		if bytes.Equal(trimLine(line), delimiter) {
+			break
+		}
+	}
+
+	// Capture the signed entity, canonicalizing line endings to CRLF
+	signed := &bytes.Buffer{}
+	for {
+		line, err = readLine(br, budget)
+		budget -= int64(len(line))
+		if err == io.EOF {
+			return ErrMalformedSigned
+		}
+		if err != nil {
+			return
+		}
+		if bytes.HasPrefix(line, delimiter) {
+			rest := trimLine(line[len(delimiter):])
+			if len(rest) == 0 {
+				break
+			}
+			if string(rest) == "--" {
+				return ErrMalformedSigned
+			}
+		}
+		signed.Write(bytes.TrimRight(line, "\r\n"))
+		signed.WriteString("\r\n")
+	}
+
+	// The CRLF preceding the delimiter belongs to the delimiter
+	content := signed.Bytes()
+	if len(content) < 2 {
+		return ErrMalformedSigned
+	}
+	content = content[:len(content)-2]
+
+	// The rest is a regular multipart body starting with the signature part
+	mr := multipart.NewReader(io.MultiReader(bytes.NewReader(line), br), params["boundary"])
+
+	var sp *multipart.Part
+	sp, err = mr.NextPart()
+	if err == io.EOF {
+		return ErrMalformedSigned
+	}
+	if err != nil {
+		return
+	}
+
+	status := SignatureStatus{
+		Protocol: params["protocol"],
+		Micalg:   params["micalg"],
+		Header:   sp.Header,
+	}
+
+	sigct, _, _ := mime.ParseMediaType(sp.Header.Get("Content-Type"))
+	if !strings.EqualFold(sigct, status.Protocol) {
+		status.Err = errors.Errorf("Mimestream: signature part is %q, expected %q", sigct, status.Protocol)
+	} else {
+		sig := contentDecoderReader(sp.Header, sp)
+		status.Err = ps.Verifier.Verify(status.Protocol, status.Micalg, content, sig)
+
+		// Whatever the verifier left unread
+		_, err = io.Copy(ioutil.Discard, sig)
+		if err != nil {
+			return
+		}
+	}
+
+	// Consume the closing delimiter (and anything a broken sender added)
+	var partsCounter int
+	for {
+		_, err = mr.NextPart()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+		partsCounter++
+		if partsCounter > MaximumPartsPerMultipart {
+			return ErrMaximumPartsPerMultipart
+		}
+	}
+
+	if ps.SignatureHandler != nil {
+		err = ps.SignatureHandler(status)
+		if err != nil {
+			return
+		}
+	}
+
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(content)))
+
+	var header textproto.MIMEHeader
+	header, err = tp.ReadMIMEHeader()
+	if err != nil {
+		return
+	}
+
+	return ps.parseMIMEParts(st, childPath(path, 0), header, tp.R, handler, level+1)
+}
+
+// readLine returns the next line including the line ending, giving up once
+// the line is longer than max
+func readLine(br *bufio.Reader, max int64) (line []byte, err error) {
+	for {
+		var chunk []byte
+		chunk, err = br.ReadSlice('\n')
+		line = append(line, chunk...)
+		if int64(len(line)) > max {
+			return nil, ErrMaximumSignedSize
+		}
+		if err != bufio.ErrBufferFull {
+			return
+		}
+	}
+}
+
+// trimLine removes the line ending and any transport padding
+func trimLine(line []byte) []byte {
+	return bytes.TrimRight(line, " \t\r\n")
+}
@@ -0,0 +1,157 @@
+package mimestream
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// hmacVerifier stands in for S/MIME or PGP with a shared secret
+type hmacVerifier struct {
+	key    []byte
+	signed []byte
+}
+
+func (v *hmacVerifier) sign(b []byte) string {
+	mac := hmac.New(sha256.New, v.key)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (v *hmacVerifier) Verify(protocol, micalg string, signed []byte, signature io.Reader) error {
+	v.signed = signed
+	sig, err := ioutil.ReadAll(signature)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(strings.TrimSpace(string(sig))), []byte(v.sign(signed))) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+func signedMessage(signedEntity, signature string) string {
+	return strings.Join([]string{
+		"From: John <john@example.com>",
+		"Subject: Signed",
+		`Content-Type: multipart/signed; protocol="application/x-hmac"; micalg=sha-256; boundary="outer"`,
+		"",
+		"This is a preamble",
+		"--outer",
+		signedEntity,
+		"--outer",
+		"Content-Type: application/x-hmac",
+		"",
+		signature,
+		"--outer--",
+		"",
+	}, "\r\n")
+}
+
+func TestSignedReader(t *testing.T) {
+
+	signedEntity := strings.Join([]string{
+		`Content-Type: multipart/alternative; boundary="inner"`,
+		"",
+		"--inner",
+		"Content-Type: text/plain",
+		"",
+		"Hello",
+		"--inner",
+		"Content-Type: text/html",
+		"Content-Transfer-Encoding: base64",
+		"",
+		"PHA+SGVsbG88L3A+",
+		"--inner--",
+	}, "\r\n")
+
+	v := &hmacVerifier{key: []byte("secret")}
+
+	tests := []struct {
+		name     string
+		message  string
+		verified bool
+	}{
+		{"valid", signedMessage(signedEntity, v.sign([]byte(signedEntity))), true},
+		{"tampered", signedMessage(strings.Replace(signedEntity, "Hello", "Hallo", 1), v.sign([]byte(signedEntity))), false},
+		{"bare LF", strings.Replace(signedMessage(signedEntity, v.sign([]byte(signedEntity))), "\r\n", "\n", -1), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var statuses []SignatureStatus
+			var bodies []string
+
+			p := &Parser{
+				Verifier: v,
+				SignatureHandler: func(s SignatureStatus) error {
+					statuses = append(statuses, s)
+					return nil
+				},
+			}
+
+			err := p.HandleEmailFromReader(strings.NewReader(test.message), func(header textproto.MIMEHeader, body io.Reader) error {
+				b, err := ioutil.ReadAll(body)
+				bodies = append(bodies, string(b))
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(statuses) != 1 {
+				t.Fatalf("Invalid number of signatures:\n\tGot:%d\n\tWant:%d\n", len(statuses), 1)
+			}
+
+			if statuses[0].Verified() != test.verified {
+				t.Errorf("Invalid verification:\n\tGot:%v (%v)\n\tWant:%v\n", statuses[0].Verified(), statuses[0].Err, test.verified)
+			}
+
+			if statuses[0].Micalg != "sha-256" {
+				t.Errorf("Invalid micalg: %q", statuses[0].Micalg)
+			}
+
+			if strings.Contains(string(v.signed), "\n") && !strings.Contains(string(v.signed), "\r\n") {
+				t.Errorf("Signed content not canonicalized: %q", v.signed)
+			}
+
+			want := []string{"Hello", "<p>Hello</p>"}
+			if test.name == "tampered" {
+				want[0] = "Hallo"
+			}
+			if strings.Join(bodies, "|") != strings.Join(want, "|") {
+				t.Errorf("Invalid bodies:\n\tGot:%q\n\tWant:%q\n", bodies, want)
+			}
+		})
+	}
+}
+
+func TestSignedReaderMalformed(t *testing.T) {
+	message := strings.Join([]string{
+		`Content-Type: multipart/signed; protocol="application/x-hmac"; boundary="outer"`,
+		"",
+		"--outer",
+		"Content-Type: text/plain",
+		"",
+		"Hello",
+		"--outer--",
+		"",
+	}, "\r\n")
+
+	p := &Parser{Verifier: &hmacVerifier{}}
+	err := p.HandleEmailFromReader(strings.NewReader(message), func(textproto.MIMEHeader, io.Reader) error {
+		return nil
+	})
+
+	if err != ErrMalformedSigned {
+		t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, ErrMalformedSigned)
+	}
+}
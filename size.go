@@ -0,0 +1,170 @@
+package mimestream
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// ErrUnknownSize when the size of a part can't be known without reading it
+var ErrUnknownSize = errors.New("Mimestream: Unknown part size")
+
+// sizer is implemented by parts that know their exact encoded size in advance
+type sizer interface {
+	// partSize returns the header Add will write and the length of the body.
+	// A nil header means Add writes nothing at all.
+	partSize(s *writeState, path string) (header textproto.MIMEHeader, size int64, err error)
+}
+
+// Size is the exact number of bytes Into writes to a multipart.Writer with the
+// given boundary, including base64 expansion and line breaks, headers and
+// boundaries. It fails with ErrUnknownSize unless the size of every source is
+// known (File.Size, an io.Seeker, an os.File or a Len method).
+func (p Parts) Size(boundary string) (int64, error) {
+	return multipartSize(defaultState(), "", p, boundary)
+}
+
+// multipartSize is the exact number of bytes the parts at path take in a
+// multipart using the given boundary
+func multipartSize(s *writeState, path string, parts Parts, boundary string) (total int64, err error) {
+	b := int64(len(boundary))
+
+	var written int
+	for i, part := range parts {
+		ps, ok := part.(sizer)
+		if !ok {
+			return 0, errors.Wrap(ErrUnknownSize, fmt.Sprintf("failed to size %T part", part))
+		}
+
+		var header textproto.MIMEHeader
+		var size int64
+		header, size, err = ps.partSize(s, childPath(path, i))
+		if err != nil {
+			s.recordSize(childPath(path, i), -1)
+			return 0, errors.Wrap(err, fmt.Sprintf("failed to size %T part", part))
+		}
+		if header != nil {
+			s.recordSize(childPath(path, i), size)
+		}
+
+		if header == nil {
+			continue
+		}
+
+		// "--boundary\r\n" or "\r\n--boundary\r\n"
+		total += 2 + b + 2
+		if written > 0 {
+			total += 2
+		}
+		written++
+
+		total += headerSize(header) + size
+	}
+
+	// "\r\n--boundary--\r\n"
+	total += 2 + 2 + b + 2 + 2
+	return
+}
+
+// multipartPartSize is the size of a nested multipart written by
+// writeState.addMultipart
+func multipartPartSize(s *writeState, path, contentType string, parts Parts) (header textproto.MIMEHeader, size int64, err error) {
+	if len(parts) == 0 {
+		return
+	}
+
+	boundary := s.boundary(path)
+	size, err = multipartSize(s, path, parts, boundary)
+	return multipartHeader(contentType, boundary), size, err
+}
+
+// multipartHeader of a nested multipart
+func multipartHeader(contentType, boundary string) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Type": []string{fmt.Sprintf("%s; boundary=%s", contentType, boundary)},
+	}
+}
+
+// headerSize of a part header as written by multipart.Writer.CreatePart
+func headerSize(header textproto.MIMEHeader) (total int64) {
+	for k, vv := range header {
+		for _, v := range vv {
+			// "Key: value\r\n"
+			total += int64(len(k) + 2 + len(v) + 2)
+		}
+	}
+	return total + 2
+}
+
+// messageHeaderSize of a header block as written by writeHeader
+func messageHeaderSize(header textproto.MIMEHeader) (total int64) {
+	for k, vv := range header {
+		for _, v := range vv {
+			total += int64(len(foldHeaderLine(k, v)) + 2)
+		}
+	}
+	return total + 2
+}
+
+// readerSize returns how many bytes are left in r, if that can be known
+// without reading it
+func readerSize(r io.Reader) (int64, bool) {
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		return int64(v.Len()), true
+
+	case io.Seeker:
+		current, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false
+		}
+		end, err := v.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, false
+		}
+		_, err = v.Seek(current, io.SeekStart)
+		if err != nil {
+			return 0, false
+		}
+		return end - current, true
+
+	case interface{ Stat() (os.FileInfo, error) }:
+		info, err := v.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return 0, false
+		}
+		return info.Size(), true
+	}
+
+	return 0, false
+}
+
+// base64Size of n bytes encoded by NewMimeBase64Writer
+func base64Size(n int64) int64 {
+	encoded := (n + 2) / 3 * 4
+	if encoded == 0 {
+		return 0
+	}
+
+	// "\r\n" between every 76 characters
+	return encoded + (encoded-1)/76*2
+}
+
+// newBoundary is a boundary of the same length mime/multipart would pick
+func newBoundary() string {
+	return multipart.NewWriter(nil).Boundary()
+}
+
+// byteCounter counts the bytes written to it
+type byteCounter struct {
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,123 @@
+package mimestream
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestBase64Size(t *testing.T) {
+	for n := 0; n < 300; n++ {
+		buf := &bytes.Buffer{}
+		w := NewMimeBase64Writer(buf)
+		w.Write(make([]byte, n))
+		w.Close()
+
+		if got := base64Size(int64(n)); got != int64(buf.Len()) {
+			t.Errorf("base64Size(%d):\n\tGot:%d\n\tWant:%d\n", n, got, buf.Len())
+		}
+	}
+}
+
+func TestSize(t *testing.T) {
+
+	parts := func() Parts {
+		return Parts{
+			Alternative{
+				Parts: Parts{
+					Text{Text: "This is the text that goes in the plain part. It will need to be wrapped to 76 characters and quoted."},
+					Text{ContentType: TextHTML, Text: "<p>This is the text that goes in the plain part. It will need to be wrapped to 76 characters and quoted.</p>"},
+				},
+			},
+			Mixed{
+				Parts: Parts{
+					File{Name: "filename.jpg", Reader: bytes.NewReader(make([]byte, 1024*1024+1))},
+					Mixed{},
+				},
+			},
+			File{Name: "filename-2 שלום.txt", Inline: true, Reader: mockDataSrc(12345), Size: 12345},
+			FormField{Name: "field", Value: "value"},
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+
+	size, err := parts().Size(mw.Boundary())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = parts().Into(mw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size != int64(buf.Len()) {
+		t.Errorf("Invalid Parts size:\n\tGot:%d\n\tWant:%d\n", size, buf.Len())
+	}
+
+	m := Message{
+		Header: textproto.MIMEHeader{"Subject": []string{"Size"}},
+		Parts:  parts(),
+	}
+
+	size, err = m.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &byteCounter{}
+	err = m.Into(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size != c.n {
+		t.Errorf("Invalid Message size:\n\tGot:%d\n\tWant:%d\n", size, c.n)
+	}
+}
+
+func TestSizeUnknown(t *testing.T) {
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	for _, part := range []Part{
+		File{Name: "stream.bin", Reader: mockDataSrc(10)},
+		Mixed{Parts: Parts{FormFile{Name: "pipe.bin", Reader: pr}}},
+		customPart{},
+	} {
+		_, err := Parts{part}.Size("boundary")
+		if errors.Cause(err) != ErrUnknownSize {
+			t.Errorf("Invalid error for %T:\n\tGot:%v\n\tWant:%v\n", part, err, ErrUnknownSize)
+		}
+	}
+
+	// Sizing a seekable source must not consume it
+	r := strings.NewReader("payload")
+	r.Seek(3, io.SeekStart)
+
+	_, err := Parts{File{Name: "payload.txt", Reader: r}}.Size("boundary")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := ioutil.ReadAll(r)
+	if string(b) != "load" {
+		t.Errorf("Sizing moved the reader:\n\tGot:%q\n\tWant:%q\n", b, "load")
+	}
+}
+
+// customPart can't tell its size
+type customPart struct{}
+
+func (customPart) Add(w *multipart.Writer) error {
+	return nil
+}
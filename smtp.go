@@ -0,0 +1,419 @@
+package mimestream
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrMessageTooLarge when the message is bigger than the server SIZE limit
+var ErrMessageTooLarge = errors.New("Mimestream: Message exceeds the server size limit")
+
+// ErrTLSRequired when the server does not offer STARTTLS but TLS is required
+// (or credentials would be sent in the clear)
+var ErrTLSRequired = errors.New("Mimestream: SMTP server does not support STARTTLS")
+
+// ErrAuthUnsupported when the server supports neither AUTH PLAIN nor LOGIN
+var ErrAuthUnsupported = errors.New("Mimestream: SMTP server does not support AUTH PLAIN or LOGIN")
+
+// ErrSMTPUTF8Unsupported when an address is not ASCII but the server does not
+// support SMTPUTF8
+var ErrSMTPUTF8Unsupported = errors.New("Mimestream: SMTP server does not support SMTPUTF8")
+
+// ErrInvalidAddress for envelope addresses that would corrupt an SMTP command
+var ErrInvalidAddress = errors.New("Mimestream: Invalid envelope address")
+
+// SMTPError is a negative reply from an SMTP server
+type SMTPError struct {
+	Code    int
+	Message string
+}
+
+func (e *SMTPError) Error() string {
+	return fmt.Sprintf("Mimestream: SMTP %d %s", e.Code, e.Message)
+}
+
+// Temporary reports 4xx replies which may succeed when retried later
+func (e *SMTPError) Temporary() bool {
+	return e.Code >= 400 && e.Code < 500
+}
+
+// Sender submits messages to an SMTP server. The message is written straight
+// into the DATA command so attachments are never held in memory or on disk.
+type Sender struct {
+	// Addr is the host:port of the server
+	Addr string
+
+	// LocalName is sent with EHLO (defaults to "localhost")
+	LocalName string
+
+	// TLSConfig is used for STARTTLS (defaults to verifying the Addr host)
+	TLSConfig *tls.Config
+
+	// RequireTLS fails when the server does not offer STARTTLS
+	RequireTLS bool
+
+	// Username and Password for AUTH PLAIN or LOGIN. Credentials are only sent
+	// over TLS unless AllowInsecureAuth is set.
+	Username          string
+	Password          string
+	AllowInsecureAuth bool
+
+	// Dial opens the connection (defaults to net.Dial). Returning a *tls.Conn
+	// gives implicit TLS (port 465).
+	Dial func(network, addr string) (net.Conn, error)
+}
+
+// Send the Message to the recipients. When the size of the message is known
+// (see Message.Size) it is declared up front so an oversized message is
+// refused before it is sent. The File.Closers are called even if the message
+// is never written.
+func (s *Sender) Send(from string, to []string, m Message) (err error) {
+	size, err := m.Size()
+	if err != nil {
+		size = -1
+	}
+
+	var written bool
+	err = s.stream(from, to, size, func(w io.Writer) error {
+		written = true
+		return m.Into(w)
+	})
+
+	if !written {
+		err = appendError(err, closeParts(m.Parts))
+	}
+	return
+}
+
+// Stream sends whatever write produces as the message body. Line endings and
+// dot-stuffing are taken care of.
+func (s *Sender) Stream(from string, to []string, write func(w io.Writer) error) error {
+	return s.stream(from, to, -1, write)
+}
+
+// stream sends the message, size is -1 when not known
+func (s *Sender) stream(from string, to []string, size int64, write func(w io.Writer) error) (err error) {
+	for _, addr := range append([]string{from}, to...) {
+		if strings.ContainsAny(addr, "<>\r\n") {
+			return ErrInvalidAddress
+		}
+	}
+
+	dial := s.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+
+	var conn net.Conn
+	conn, err = dial("tcp", s.Addr)
+	if err != nil {
+		return
+	}
+
+	c := &smtpClient{sender: s}
+	c.setConn(conn)
+	defer c.conn.Close()
+
+	err = c.hello()
+	if err != nil {
+		return
+	}
+
+	err = c.auth()
+	if err != nil {
+		return
+	}
+
+	err = c.envelope(from, to, size)
+	if err != nil {
+		return
+	}
+
+	err = c.data(write)
+	if err != nil {
+		return
+	}
+
+	_, _, err = c.cmd(221, "QUIT")
+	return
+}
+
+// smtpClient is the state of a single Sender connection
+type smtpClient struct {
+	sender *Sender
+	conn   net.Conn
+	text   *textproto.Conn
+	tls    bool
+
+	// EHLO keywords (upper case) and their parameters
+	ext map[string]string
+}
+
+func (c *smtpClient) setConn(conn net.Conn) {
+	c.conn = conn
+	c.text = textproto.NewConn(conn)
+	_, c.tls = conn.(*tls.Conn)
+}
+
+// cmd sends a command and reads the reply, turning unexpected codes into an
+// *SMTPError
+func (c *smtpClient) cmd(expectCode int, format string, args ...interface{}) (code int, msg string, err error) {
+	var id uint
+	id, err = c.text.Cmd(format, args...)
+	if err != nil {
+		return
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	return c.reply(expectCode)
+}
+
+func (c *smtpClient) reply(expectCode int) (code int, msg string, err error) {
+	code, msg, err = c.text.ReadResponse(expectCode)
+	if e, ok := err.(*textproto.Error); ok {
+		err = &SMTPError{Code: e.Code, Message: e.Msg}
+	}
+	return
+}
+
+// hello reads the greeting, says EHLO and upgrades to TLS when possible
+func (c *smtpClient) hello() (err error) {
+	_, _, err = c.reply(220)
+	if err != nil {
+		return
+	}
+
+	err = c.ehlo()
+	if err != nil {
+		return
+	}
+
+	if c.tls {
+		return
+	}
+
+	if _, ok := c.ext["STARTTLS"]; !ok {
+		if c.sender.RequireTLS {
+			return ErrTLSRequired
+		}
+		return
+	}
+
+	_, _, err = c.cmd(220, "STARTTLS")
+	if err != nil {
+		return
+	}
+
+	config := c.sender.TLSConfig
+	if config == nil {
+		host, _, _ := net.SplitHostPort(c.sender.Addr)
+		config = &tls.Config{ServerName: host}
+	}
+
+	c.setConn(tls.Client(c.conn, config))
+	return c.ehlo()
+}
+
+// ehlo falls back to HELO (and no extensions) for ancient servers
+func (c *smtpClient) ehlo() (err error) {
+	name := c.sender.LocalName
+	if name == "" {
+		name = "localhost"
+	}
+
+	c.ext = map[string]string{}
+
+	var msg string
+	_, msg, err = c.cmd(250, "EHLO %s", name)
+	if err != nil {
+		_, _, err = c.cmd(250, "HELO %s", name)
+		return
+	}
+
+	lines := strings.Split(msg, "\n")
+	for _, line := range lines[1:] {
+		kv := strings.SplitN(line, " ", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "")
+		}
+		c.ext[strings.ToUpper(kv[0])] = kv[1]
+	}
+	return
+}
+
+// auth logs in with the Sender credentials (if any)
+func (c *smtpClient) auth() (err error) {
+	if c.sender.Username == "" {
+		return
+	}
+
+	if !c.tls && !c.sender.AllowInsecureAuth {
+		return ErrTLSRequired
+	}
+
+	mechanisms := " " + strings.ToUpper(c.ext["AUTH"]) + " "
+
+	if strings.Contains(mechanisms, " PLAIN ") {
+		credentials := "\x00" + c.sender.Username + "\x00" + c.sender.Password
+		_, _, err = c.cmd(235, "AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte(credentials)))
+		return
+	}
+
+	if strings.Contains(mechanisms, " LOGIN ") {
+		_, _, err = c.cmd(334, "AUTH LOGIN")
+		if err != nil {
+			return
+		}
+		_, _, err = c.cmd(334, "%s", base64.StdEncoding.EncodeToString([]byte(c.sender.Username)))
+		if err != nil {
+			return
+		}
+		_, _, err = c.cmd(235, "%s", base64.StdEncoding.EncodeToString([]byte(c.sender.Password)))
+		return
+	}
+
+	return ErrAuthUnsupported
+}
+
+// mailParams builds the MAIL FROM parameters the server supports
+func (c *smtpClient) mailParams(from string, to []string, size int64) (params string, err error) {
+	if max, ok := c.ext["SIZE"]; ok && size >= 0 {
+		if limit, _ := strconv.ParseInt(max, 10, 64); limit > 0 && size > limit {
+			return "", ErrMessageTooLarge
+		}
+		params += fmt.Sprintf(" SIZE=%d", size)
+	}
+
+	if _, ok := c.ext["8BITMIME"]; ok {
+		params += " BODY=8BITMIME"
+	}
+
+	for _, addr := range append([]string{from}, to...) {
+		if !isASCII(addr) {
+			if _, ok := c.ext["SMTPUTF8"]; !ok {
+				return "", ErrSMTPUTF8Unsupported
+			}
+			params += " SMTPUTF8"
+			break
+		}
+	}
+	return
+}
+
+// envelope sends MAIL FROM, RCPT TO and DATA. With PIPELINING all commands are
+// sent at once before reading the replies.
+func (c *smtpClient) envelope(from string, to []string, size int64) (err error) {
+	var params string
+	params, err = c.mailParams(from, to, size)
+	if err != nil {
+		return
+	}
+
+	commands := []string{fmt.Sprintf("MAIL FROM:<%s>%s", from, params)}
+	for _, addr := range to {
+		commands = append(commands, fmt.Sprintf("RCPT TO:<%s>", addr))
+	}
+
+	if _, ok := c.ext["PIPELINING"]; !ok {
+		for i, command := range commands {
+			expect := 250
+			if i > 0 {
+				expect = 25
+			}
+			_, _, err = c.cmd(expect, "%s", command)
+			if err != nil {
+				return
+			}
+		}
+		_, _, err = c.cmd(354, "DATA")
+		return
+	}
+
+	commands = append(commands, "DATA")
+	for _, command := range commands {
+		c.text.W.WriteString(command + "\r\n")
+	}
+	err = c.text.W.Flush()
+	if err != nil {
+		return
+	}
+
+	// Every reply must be read, the first failure is the one that matters
+	for i := range commands {
+		expect := 25
+		switch i {
+		case 0:
+			expect = 250
+		case len(commands) - 1:
+			expect = 354
+		}
+
+		_, _, rerr := c.reply(expect)
+		if rerr != nil && err == nil {
+			err = rerr
+		}
+
+		// The server is waiting for a message we no longer want to send.
+		// Closing without the final dot abandons the transaction.
+		if i == len(commands)-1 && rerr == nil && err != nil {
+			c.conn.Close()
+		}
+	}
+	return
+}
+
+// data streams the message after a 354 reply and reads the final reply
+func (c *smtpClient) data(write func(w io.Writer) error) (err error) {
+	dw := NewDataWriter(c.text.W)
+
+	var w io.Writer = dw
+	if max, _ := strconv.ParseInt(c.ext["SIZE"], 10, 64); max > 0 {
+		w = &limitedWriter{w: dw, n: max}
+	}
+
+	err = write(w)
+	if err != nil {
+		// Without the final dot the server drops the message
+		c.conn.Close()
+		return
+	}
+
+	err = dw.Close()
+	if err != nil {
+		return
+	}
+
+	_, _, err = c.reply(250)
+	return
+}
+
+// limitedWriter fails once more than n bytes are written
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		return 0, ErrMessageTooLarge
+	}
+	l.n -= int64(len(p))
+	return l.w.Write(p)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
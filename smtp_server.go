@@ -0,0 +1,432 @@
+package mimestream
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Envelope of a message received by a Server
+type Envelope struct {
+	RemoteAddr net.Addr
+
+	// Helo is the name the client gave with HELO, EHLO or LHLO
+	Helo string
+
+	// From is "<>" for the null reverse-path used by bounces
+	From string
+	To   []string
+}
+
+// Server receives mail over SMTP or LMTP. The DATA stream is un-dot-stuffed
+// and fed straight into the MIME reader so messages are never buffered.
+type Server struct {
+	// Hostname for the greeting (defaults to "localhost")
+	Hostname string
+
+	// LMTP speaks LHLO instead of HELO/EHLO and replies once per recipient
+	// after DATA (RFC 2033)
+	LMTP bool
+
+	// MaxMessageBytes is advertised with SIZE and enforced while reading
+	// (0 for no limit)
+	MaxMessageBytes int64
+
+	// MaxRecipients per message (0 for no limit)
+	MaxRecipients int
+
+	// ReadTimeout and WriteTimeout limit how long each read from and write to
+	// the client can block (0 for no limit), so idle or stalled clients do
+	// not hold a connection forever
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// Parser options used for every message (optional)
+	Parser *Parser
+
+	// Mail validates the MAIL FROM address (optional). Returning an *SMTPError
+	// picks the reply code.
+	Mail func(env *Envelope, from string) error
+
+	// Rcpt validates each RCPT TO address (optional). Returning an *SMTPError
+	// picks the reply code.
+	Rcpt func(env *Envelope, to string) error
+
+	// Handler returns the part handler for the message once DATA starts
+	// (optional, bodies are discarded without one)
+	Handler func(env *Envelope) partHandler
+
+	// Delivered is called with the result of parsing the message (optional).
+	// It may return a result per recipient in env.To; missing results default
+	// to err. Only LMTP can report them separately, SMTP uses the first.
+	Delivered func(env *Envelope, err error) []error
+}
+
+// Serve accepts connections until the listener is closed
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn runs a single session and closes the connection
+func (s *Server) ServeConn(conn net.Conn) (err error) {
+	defer conn.Close()
+
+	hostname := s.Hostname
+	if hostname == "" {
+		hostname = "localhost"
+	}
+
+	protocol := "ESMTP"
+	if s.LMTP {
+		protocol = "LMTP"
+	}
+
+	text := textproto.NewConn(&deadlineConn{Conn: conn, read: s.ReadTimeout, write: s.WriteTimeout})
+	env := &Envelope{RemoteAddr: conn.RemoteAddr()}
+
+	err = text.PrintfLine("220 %s %s ready", hostname, protocol)
+	if err != nil {
+		return
+	}
+
+	var line string
+	for {
+		line, err = readCommand(text.R)
+		if err == errCommandTooLong {
+			err = text.PrintfLine("500 5.5.2 Line too long")
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		switch strings.ToUpper(verb) {
+		case "HELO", "EHLO", "LHLO":
+			if s.LMTP != strings.EqualFold(verb, "LHLO") {
+				err = text.PrintfLine("500 5.5.1 Wrong greeting for %s", protocol)
+				break
+			}
+			*env = Envelope{RemoteAddr: conn.RemoteAddr(), Helo: arg}
+			err = s.hello(text, hostname, strings.EqualFold(verb, "HELO"))
+
+		case "MAIL":
+			err = s.mail(text, env, arg)
+
+		case "RCPT":
+			err = s.rcpt(text, env, arg)
+
+		case "DATA":
+			err = s.data(text, env)
+			if err != nil {
+				return
+			}
+			*env = Envelope{RemoteAddr: env.RemoteAddr, Helo: env.Helo}
+
+		case "RSET":
+			*env = Envelope{RemoteAddr: env.RemoteAddr, Helo: env.Helo}
+			err = text.PrintfLine("250 2.0.0 OK")
+
+		case "NOOP":
+			err = text.PrintfLine("250 2.0.0 OK")
+
+		case "VRFY":
+			err = text.PrintfLine("252 2.5.0 Cannot verify user")
+
+		case "QUIT":
+			return text.PrintfLine("221 2.0.0 Bye")
+
+		default:
+			err = text.PrintfLine("500 5.5.2 Unknown command")
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) hello(text *textproto.Conn, hostname string, helo bool) error {
+	if helo {
+		return text.PrintfLine("250 %s", hostname)
+	}
+
+	lines := []string{hostname, "PIPELINING", "8BITMIME", "SMTPUTF8"}
+	if s.MaxMessageBytes > 0 {
+		lines = append(lines, fmt.Sprintf("SIZE %d", s.MaxMessageBytes))
+	}
+
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		err := text.PrintfLine("250%s%s", sep, line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) mail(text *textproto.Conn, env *Envelope, arg string) (err error) {
+	if env.Helo == "" {
+		return text.PrintfLine("503 5.5.1 Say hello first")
+	}
+	if env.From != "" {
+		return text.PrintfLine("503 5.5.1 Sender already given")
+	}
+
+	from, params, ok := parsePath(arg, "FROM:")
+	if !ok {
+		return text.PrintfLine("501 5.5.4 Syntax: MAIL FROM:<address>")
+	}
+
+	for _, param := range params {
+		kv := strings.SplitN(param, "=", 2)
+		if strings.EqualFold(kv[0], "SIZE") && len(kv) == 2 && s.MaxMessageBytes > 0 {
+			size, _ := strconv.ParseInt(kv[1], 10, 64)
+			if size > s.MaxMessageBytes {
+				return text.PrintfLine("552 5.3.4 Message size exceeds fixed maximum message size")
+			}
+		}
+	}
+
+	if s.Mail != nil {
+		err = s.Mail(env, from)
+		if err != nil {
+			return replyError(text, err, 550)
+		}
+	}
+
+	// The null reverse-path (bounces) is valid
+	if from == "" {
+		from = "<>"
+	}
+	env.From = from
+
+	return text.PrintfLine("250 2.1.0 OK")
+}
+
+func (s *Server) rcpt(text *textproto.Conn, env *Envelope, arg string) (err error) {
+	if env.From == "" {
+		return text.PrintfLine("503 5.5.1 Need MAIL before RCPT")
+	}
+
+	if s.MaxRecipients > 0 && len(env.To) >= s.MaxRecipients {
+		return text.PrintfLine("452 4.5.3 Too many recipients")
+	}
+
+	to, _, ok := parsePath(arg, "TO:")
+	if !ok || to == "" {
+		return text.PrintfLine("501 5.5.4 Syntax: RCPT TO:<address>")
+	}
+
+	if s.Rcpt != nil {
+		err = s.Rcpt(env, to)
+		if err != nil {
+			return replyError(text, err, 550)
+		}
+	}
+
+	env.To = append(env.To, to)
+	return text.PrintfLine("250 2.1.5 OK")
+}
+
+func (s *Server) data(text *textproto.Conn, env *Envelope) (err error) {
+	if env.From == "" || len(env.To) == 0 {
+		return text.PrintfLine("503 5.5.1 Need MAIL and RCPT before DATA")
+	}
+
+	err = text.PrintfLine("354 Start mail input; end with <CRLF>.<CRLF>")
+	if err != nil {
+		return
+	}
+
+	dr := text.DotReader()
+
+	var r io.Reader = dr
+	if s.MaxMessageBytes > 0 {
+		r = &limitedReader{r: dr, n: s.MaxMessageBytes}
+	}
+
+	handler := discardHandler
+	if s.Handler != nil {
+		handler = s.Handler(env)
+	}
+
+	parser := s.Parser
+	if parser == nil {
+		parser = &Parser{}
+	}
+
+	result := parser.HandleEmailFromReader(r, handler)
+
+	// Whatever the handler did not read, up to the final dot, so we are back
+	// in sync with the client. A broken stream means the client is gone.
+	_, err = io.Copy(ioutil.Discard, dr)
+	if err != nil {
+		return
+	}
+
+	var results []error
+	if s.Delivered != nil {
+		results = s.Delivered(env, result)
+	}
+
+	replies := 1
+	if s.LMTP {
+		replies = len(env.To)
+	}
+
+	for i := 0; i < replies; i++ {
+		rerr := result
+		if i < len(results) {
+			rerr = results[i]
+		}
+
+		if rerr == nil {
+			err = text.PrintfLine("250 2.0.0 OK")
+		} else if errors.Cause(rerr) == ErrMessageTooLarge {
+			err = text.PrintfLine("552 5.3.4 Message size exceeds fixed maximum message size")
+		} else {
+			err = replyError(text, rerr, 554)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// maxCommandLine is the longest command line accepted, with the CRLF (RFC 5321
+// section 4.5.3.1.4)
+const maxCommandLine = 512
+
+var errCommandTooLong = errors.New("Mimestream: SMTP command line too long")
+
+// readCommand reads a command line without its CRLF. A line longer than
+// maxCommandLine is skipped without buffering it and is an errCommandTooLong.
+func readCommand(r *bufio.Reader) (line string, err error) {
+	var buf []byte
+	var tooLong bool
+	for {
+		var chunk []byte
+		chunk, err = r.ReadSlice('\n')
+		if len(buf)+len(chunk) > maxCommandLine {
+			tooLong, buf = true, nil
+		} else if !tooLong {
+			buf = append(buf, chunk...)
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if tooLong {
+			return "", errCommandTooLong
+		}
+		return strings.TrimRight(string(buf), "\r\n"), nil
+	}
+}
+
+// deadlineConn sets the deadline of the connection before every read and
+// write (when the timeout is not 0)
+type deadlineConn struct {
+	net.Conn
+	read, write time.Duration
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	if c.read > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.read))
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	if c.write > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.write))
+	}
+	return c.Conn.Write(p)
+}
+
+// parsePath splits "FROM:<address> PARAM=1" into the address and parameters
+func parsePath(arg, prefix string) (address string, params []string, ok bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+
+	if !strings.HasPrefix(arg, "<") {
+		return
+	}
+	end := strings.IndexByte(arg, '>')
+	if end < 0 {
+		return
+	}
+
+	return arg[1:end], strings.Fields(arg[end+1:]), true
+}
+
+// replyTexts for errors that are not an *SMTPError. The error itself is never
+// sent as it can leak internal details to the client.
+var replyTexts = map[int]string{
+	550: "5.7.1 Requested action not taken",
+	554: "5.6.0 Transaction failed",
+}
+
+// replyError replies with an *SMTPError as given, or with code and a generic
+// text for anything else
+func replyError(text *textproto.Conn, err error, code int) error {
+	if e, ok := errors.Cause(err).(*SMTPError); ok {
+		return text.PrintfLine("%d %s", e.Code, e.Message)
+	}
+	return text.PrintfLine("%d %s", code, replyTexts[code])
+}
+
+// discardHandler ignores every part
+func discardHandler(textproto.MIMEHeader, io.Reader) error {
+	return nil
+}
+
+// limitedReader fails once more than n bytes are read
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (n int, err error) {
+	n, err = l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, ErrMessageTooLarge
+	}
+	return
+}
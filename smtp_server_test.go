@@ -0,0 +1,231 @@
+package mimestream
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestServer(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	type received struct {
+		env   Envelope
+		sizes []int64
+		err   error
+	}
+	results := make(chan received, 1)
+
+	server := &Server{
+		MaxMessageBytes: 1024 * 1024 * 10,
+		Rcpt: func(env *Envelope, to string) error {
+			if strings.HasPrefix(to, "nobody@") {
+				return &SMTPError{Code: 550, Message: "5.1.1 No such user"}
+			}
+			return nil
+		},
+		Handler: func(env *Envelope) partHandler {
+			r := &received{env: *env}
+			return func(header textproto.MIMEHeader, body io.Reader) error {
+				n, err := io.Copy(ioutil.Discard, body)
+				r.sizes = append(r.sizes, n)
+				if len(r.sizes) == 2 {
+					results <- *r
+				}
+				return err
+			}
+		},
+	}
+	go server.Serve(l)
+
+	sender := &Sender{Addr: l.Addr().String()}
+
+	err = sender.Send("john@example.com", []string{"user@example.com"}, Message{
+		Parts: Parts{
+			Text{Text: "Hello"},
+			File{Name: "filename.jpg", Reader: mockDataSrc(1024 * 1024)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-results
+	if r.env.From != "john@example.com" || strings.Join(r.env.To, ",") != "user@example.com" {
+		t.Errorf("Invalid envelope: %+v", r.env)
+	}
+	if r.sizes[1] != 1024*1024 {
+		t.Errorf("Invalid attachment size:\n\tGot:%d\n\tWant:%d\n", r.sizes[1], 1024*1024)
+	}
+
+	err = sender.Send("john@example.com", []string{"nobody@example.com"}, Message{})
+	if e, ok := err.(*SMTPError); !ok || e.Code != 550 {
+		t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, &SMTPError{Code: 550, Message: "5.1.1 No such user"})
+	}
+
+	err = sender.Send("john@example.com", []string{"user@example.com"}, Message{
+		Parts: Parts{
+			File{Name: "filename.jpg", Reader: mockDataSrc(1024 * 1024 * 11)},
+		},
+	})
+	if errors.Cause(err) != ErrMessageTooLarge {
+		t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, ErrMessageTooLarge)
+	}
+
+	// When the size is known the message is refused before it is sent
+	err = sender.Send("john@example.com", []string{"user@example.com"}, Message{
+		Parts: Parts{
+			File{Name: "filename.jpg", Reader: mockDataSrc(1024 * 1024 * 11), Size: 1024 * 1024 * 11},
+		},
+	})
+	if err != ErrMessageTooLarge {
+		t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, ErrMessageTooLarge)
+	}
+}
+
+func TestServerLMTP(t *testing.T) {
+
+	server := &Server{
+		LMTP: true,
+		Delivered: func(env *Envelope, err error) []error {
+			return []error{err, errors.New("Mailbox full")}
+		},
+	}
+
+	client, conn := net.Pipe()
+	go server.ServeConn(conn)
+
+	text := textproto.NewConn(client)
+	defer text.Close()
+
+	// No MIME headers at all, so text/plain by default
+	message := strings.Join([]string{
+		"From: john@example.com",
+		"Subject: Hello",
+		"",
+		"..Hello",
+		".",
+	}, "\r\n")
+
+	steps := []struct {
+		command string
+		codes   []int
+	}{
+		{"", []int{220}},
+		{"EHLO localhost", []int{500}},
+		{"LHLO localhost", []int{250}},
+		{"MAIL FROM:<>", []int{250}},
+		{"RCPT TO:<one@example.com>", []int{250}},
+		{"RCPT TO:<two@example.com>", []int{250}},
+		{"DATA", []int{354}},
+		{message, []int{250, 554}},
+		{"QUIT", []int{221}},
+	}
+
+	for _, step := range steps {
+		if step.command != "" {
+			err := text.PrintfLine("%s", step.command)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, code := range step.codes {
+			_, msg, err := text.ReadResponse(code)
+			if err != nil {
+				t.Fatalf("%q: %v", step.command, err)
+			}
+
+			// Errors are not sent to the client as they are
+			if strings.Contains(msg, "Mailbox full") {
+				t.Errorf("Invalid reply:\n\tGot:%v\n\tWant:%v\n", msg, replyTexts[code])
+			}
+		}
+	}
+}
+
+func TestServerUnstuffs(t *testing.T) {
+
+	bodies := make(chan string, 1)
+	server := &Server{
+		Handler: func(env *Envelope) partHandler {
+			return func(header textproto.MIMEHeader, body io.Reader) error {
+				b, err := ioutil.ReadAll(body)
+				bodies <- string(b)
+				return err
+			}
+		},
+	}
+
+	client, conn := net.Pipe()
+	go server.ServeConn(conn)
+
+	text := textproto.NewConn(client)
+	defer text.Close()
+
+	go func() {
+		w := bufio.NewWriter(client)
+		w.WriteString("HELO localhost\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nDATA\r\n")
+		w.WriteString("Content-Type: text/plain\r\n\r\n..one\r\ntwo\r\n.\r\nQUIT\r\n")
+		w.Flush()
+	}()
+
+	for _, code := range []int{220, 250, 250, 250, 354, 250, 221} {
+		_, _, err := text.ReadResponse(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if body := <-bodies; body != ".one\ntwo\n" {
+		t.Errorf("Invalid body:\n\tGot:%q\n\tWant:%q\n", body, ".one\ntwo\n")
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	server := &Server{ReadTimeout: 50 * time.Millisecond}
+
+	client, conn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ServeConn(conn)
+	}()
+
+	text := textproto.NewConn(client)
+	defer text.Close()
+
+	go func() {
+		w := bufio.NewWriter(client)
+		w.WriteString("HELO " + strings.Repeat("x", 10000) + "\r\nNOOP\r\n")
+		w.Flush()
+	}()
+
+	// A line that is too long is refused and the session goes on
+	for _, code := range []int{220, 500, 250} {
+		_, _, err := text.ReadResponse(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A silent client is dropped
+	select {
+	case err := <-done:
+		if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, "a timeout")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Idle client not dropped")
+	}
+}
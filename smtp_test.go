@@ -0,0 +1,206 @@
+package mimestream
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// fakeSMTPServer accepts a single connection and records the session
+type fakeSMTPServer struct {
+	listener   net.Listener
+	extensions []string
+	rejectRcpt string
+
+	commands []string
+	data     []byte
+	done     chan error
+}
+
+func newFakeSMTPServer(t *testing.T, rejectRcpt string, extensions ...string) *fakeSMTPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{listener: l, extensions: extensions, rejectRcpt: rejectRcpt, done: make(chan error, 1)}
+	go func() {
+		s.done <- s.serve()
+	}()
+	return s
+}
+
+func (s *fakeSMTPServer) serve() (err error) {
+	defer s.listener.Close()
+
+	var conn net.Conn
+	conn, err = s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost ESMTP")
+
+	var line string
+	for {
+		line, err = text.ReadLine()
+		if err != nil {
+			return
+		}
+		s.commands = append(s.commands, line)
+
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch {
+		case verb == "EHLO":
+			replies := append([]string{"localhost"}, s.extensions...)
+			for i, reply := range replies {
+				sep := "-"
+				if i == len(replies)-1 {
+					sep = " "
+				}
+				text.PrintfLine("250%s%s", sep, reply)
+			}
+		case line == "AUTH LOGIN":
+			text.PrintfLine("334 VXNlcm5hbWU6")
+			line, _ = text.ReadLine()
+			s.commands = append(s.commands, line)
+			text.PrintfLine("334 UGFzc3dvcmQ6")
+			line, _ = text.ReadLine()
+			s.commands = append(s.commands, line)
+			text.PrintfLine("235 Authenticated")
+		case verb == "AUTH":
+			text.PrintfLine("235 Authenticated")
+		case verb == "RCPT" && s.rejectRcpt != "" && strings.Contains(line, s.rejectRcpt):
+			text.PrintfLine("550 No such user")
+		case verb == "DATA":
+			text.PrintfLine("354 Go ahead")
+			s.data, err = ioutil.ReadAll(text.DotReader())
+			if err != nil {
+				return
+			}
+			text.PrintfLine("250 Queued")
+		case verb == "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("250 OK")
+		}
+	}
+}
+
+func TestSender(t *testing.T) {
+
+	// Every line starts with a dot to exercise dot-stuffing
+	dotted := ".one\n..two\n.\n"
+
+	message := func() Message {
+		return Message{
+			Header: textproto.MIMEHeader{
+				"From":    []string{"John <john@example.com>"},
+				"To":      []string{"<user@example.com>"},
+				"Subject": []string{"Streaming"},
+			},
+			Parts: Parts{
+				Text{Text: dotted},
+				File{
+					Name:   "filename.jpg",
+					Reader: mockDataSrc(1024 * 1024 * 5),
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		extensions []string
+		username   string
+	}{
+		{"plain", nil, ""},
+		{"pipelining", []string{"PIPELINING", "8BITMIME", "SIZE 100000000", "AUTH PLAIN LOGIN"}, "john"},
+		{"login", []string{"AUTH LOGIN"}, "john"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newFakeSMTPServer(t, "", test.extensions...)
+
+			sender := &Sender{
+				Addr:              server.listener.Addr().String(),
+				Username:          test.username,
+				Password:          "secret",
+				AllowInsecureAuth: true,
+			}
+
+			err := sender.Send("john@example.com", []string{"user@example.com", "other@example.com"}, message())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = <-server.done
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			session := strings.Join(server.commands, "\n")
+
+			if test.username != "" {
+				plain := base64.StdEncoding.EncodeToString([]byte("\x00john\x00secret"))
+				login := base64.StdEncoding.EncodeToString([]byte("john"))
+				if !strings.Contains(session, plain) && !strings.Contains(session, login) {
+					t.Errorf("Missing AUTH:\n%s", session)
+				}
+			}
+
+			if strings.Contains(strings.Join(test.extensions, " "), "8BITMIME") != strings.Contains(session, "BODY=8BITMIME") {
+				t.Errorf("Invalid BODY parameter:\n%s", session)
+			}
+
+			var bodies [][]byte
+			err = HandleEmailFromReader(bytes.NewReader(server.data), func(header textproto.MIMEHeader, body io.Reader) error {
+				b, err := ioutil.ReadAll(body)
+				bodies = append(bodies, b)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(bodies) != 2 {
+				t.Fatalf("Invalid number of parts found:\n\tGot:%d\n\tWant:%d\n", len(bodies), 2)
+			}
+
+			if string(bodies[0]) != dotted {
+				t.Errorf("Invalid text:\n\tGot:%q\n\tWant:%q\n", bodies[0], dotted)
+			}
+
+			if len(bodies[1]) != 1024*1024*5 {
+				t.Errorf("Invalid attachment size:\n\tGot:%d\n\tWant:%d\n", len(bodies[1]), 1024*1024*5)
+			}
+		})
+	}
+}
+
+func TestSenderRejected(t *testing.T) {
+	for _, extensions := range [][]string{nil, {"PIPELINING"}} {
+		server := newFakeSMTPServer(t, "nobody@", extensions...)
+
+		sender := &Sender{Addr: server.listener.Addr().String()}
+
+		err := sender.Stream("john@example.com", []string{"nobody@example.com"}, func(w io.Writer) error {
+			t.Error("message written after a rejected recipient")
+			return nil
+		})
+
+		if e, ok := err.(*SMTPError); !ok || e.Code != 550 {
+			t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, &SMTPError{Code: 550, Message: "No such user"})
+		}
+
+		<-server.done
+	}
+}
@@ -0,0 +1,157 @@
+package mimestream
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"net/textproto"
+)
+
+// The number of bytes looked at by DetectContentType
+const sniffLen = 512
+
+// Executables are checked before http.DetectContentType, which only knows
+// them as application/octet-stream
+var executableMagic = []struct {
+	magic       string
+	contentType string
+}{
+	{"MZ", "application/vnd.microsoft.portable-executable"},
+	{"\x7fELF", "application/x-executable"},
+	{"\xfe\xed\xfa\xce", "application/x-mach-binary"},
+	{"\xfe\xed\xfa\xcf", "application/x-mach-binary"},
+	{"\xce\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xcf\xfa\xed\xfe", "application/x-mach-binary"},
+	{"#!", "text/x-shellscript"},
+}
+
+// DetectContentType returns the media type (without parameters) of data from
+// its first 512 bytes, falling back to application/octet-stream. It knows the
+// types of http.DetectContentType plus common executables.
+func DetectContentType(data []byte) string {
+	if len(data) > sniffLen {
+		data = data[:sniffLen]
+	}
+
+	for _, m := range executableMagic {
+		if bytes.HasPrefix(data, []byte(m.magic)) {
+			return m.contentType
+		}
+	}
+
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(data))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return mediaType
+}
+
+// TypeCheck compares the declared Content-Type of a part with the type
+// detected from its first bytes
+type TypeCheck struct {
+	// Declared media type (lower case, without parameters)
+	Declared string
+
+	// Detected by DetectContentType
+	Detected string
+}
+
+// Executable reports if the body looks like a program
+func (c TypeCheck) Executable() bool {
+	for _, m := range executableMagic {
+		if c.Detected == m.contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// Mismatch reports if the body is clearly not what was declared, like an
+// executable sent as application/pdf. Plain text, zip (which includes office
+// documents) and unknown binaries are too generic to tell.
+func (c TypeCheck) Mismatch() bool {
+	switch c.Detected {
+	case "application/octet-stream", "text/plain", "application/zip":
+		return false
+	}
+	return c.Declared != c.Detected
+}
+
+// SniffContentType peeks at the first bytes of a part body (for example in a
+// handler of HandleEmailFromReader). The returned reader still yields the
+// whole body.
+func SniffContentType(header textproto.MIMEHeader, body io.Reader) (check TypeCheck, r io.Reader, err error) {
+	br := bufioReader(body)
+	check, err = sniffPart(header, br)
+	return check, br, err
+}
+
+// sniffPart peeks at br without consuming anything
+func sniffPart(header textproto.MIMEHeader, br *bufio.Reader) (check TypeCheck, err error) {
+	check.Declared, _, _ = mime.ParseMediaType(header.Get("Content-Type"))
+
+	var data []byte
+	data, err = br.Peek(sniffLen)
+	if err == io.EOF || err == bufio.ErrBufferFull {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+
+	check.Detected = DetectContentType(data)
+	return
+}
+
+// sniff fills in the ContentType of a File from its first bytes, if enabled
+// (see Writer.Sniff) and there is no ContentType. The Reader is replaced so
+// the peeked bytes are still sent.
+func (f File) sniff(enabled bool) (File, error) {
+	if !enabled || f.ContentType != "" {
+		return f, nil
+	}
+
+	br := bufio.NewReaderSize(f.Reader, sniffLen)
+	data, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return f, err
+	}
+
+	f.ContentType = DetectContentType(data)
+	f.Reader = br
+	return f, nil
+}
+
+// sniffSize is sniff for Parts.Size, which must not consume the Reader. Only
+// an io.ReadSeeker can be sniffed and put back.
+func (f File) sniffSize(enabled bool) (File, error) {
+	if !enabled || f.ContentType != "" {
+		return f, nil
+	}
+
+	rs, ok := f.Reader.(io.ReadSeeker)
+	if !ok {
+		return f, ErrUnknownSize
+	}
+
+	current, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return f, ErrUnknownSize
+	}
+
+	data := make([]byte, sniffLen)
+	n, err := io.ReadFull(rs, data)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return f, err
+	}
+
+	_, err = rs.Seek(current, io.SeekStart)
+	if err != nil {
+		return f, err
+	}
+
+	f.ContentType = DetectContentType(data[:n])
+	return f, nil
+}
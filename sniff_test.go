@@ -0,0 +1,179 @@
+package mimestream
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"MZ\x90\x00\x03\x00\x00\x00", "application/vnd.microsoft.portable-executable"},
+		{"\x7fELF\x02\x01\x01", "application/x-executable"},
+		{"#!/bin/sh\nrm -rf /\n", "text/x-shellscript"},
+		{"%PDF-1.4\n", "application/pdf"},
+		{"\x89PNG\r\n\x1a\n", "image/png"},
+		{"Hello", "text/plain"},
+		{"", "text/plain"},
+		{"\x00\x01\x02", "application/octet-stream"},
+	}
+
+	for _, test := range tests {
+		got := DetectContentType([]byte(test.data))
+		if got != test.want {
+			t.Errorf("Invalid type for %q:\n\tGot:%s\n\tWant:%s\n", test.data, got, test.want)
+		}
+	}
+}
+
+func TestFileSniff(t *testing.T) {
+	pdf := "%PDF-1.4\n" + strings.Repeat("pdf ", 1000)
+
+	tests := []struct {
+		name  string
+		file  File
+		sniff bool
+		want  string
+	}{
+		{"no extension", File{Name: "document", Reader: strings.NewReader(pdf)}, true, "application/pdf"},
+		{"extension", File{Name: "document.txt", Reader: strings.NewReader(pdf)}, false, "text/plain"},
+		{"extension sniffed", File{Name: "document.txt", Reader: strings.NewReader(pdf)}, true, "application/pdf"},
+		{"declared", File{Name: "document", ContentType: "text/csv", Reader: strings.NewReader(pdf)}, true, "text/csv"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wr := &Writer{Sniff: test.sniff}
+
+			size, err := wr.Size(Parts{test.file})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			mw := multipart.NewWriter(&buf)
+			err = wr.Into(mw, Parts{test.file})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if int64(buf.Len()) != size {
+				t.Errorf("Invalid size:\n\tGot:%d\n\tWant:%d\n", size, buf.Len())
+			}
+
+			p, err := multipart.NewReader(&buf, mw.Boundary()).NextPart()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := p.Header.Get("Content-Type"); !strings.HasPrefix(got, test.want+";") {
+				t.Errorf("Invalid Content-Type:\n\tGot:%s\n\tWant:%s\n", got, test.want)
+			}
+		})
+	}
+
+	// Without Sniff the explicit File.Size is enough, the Reader is not read
+	report := File{Name: "report", Size: 5, Reader: io.MultiReader(strings.NewReader("hello"))}
+	size, err := (&Writer{}).Size(Parts{report})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	mw := multipart.NewWriter(&out)
+	err = (&Writer{}).Into(mw, Parts{report})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(out.Len()) != size {
+		t.Errorf("Invalid size:\n\tGot:%d\n\tWant:%d\n", size, out.Len())
+	}
+
+	// A Reader that can not be put back is still sent whole, but its size is
+	// unknown when sniffed
+	file := File{Name: "document", Reader: io.MultiReader(strings.NewReader(pdf))}
+	if _, err := (&Writer{Sniff: true}).Size(Parts{file}); errors.Cause(err) != ErrUnknownSize {
+		t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, ErrUnknownSize)
+	}
+
+	var body []byte
+	var buf bytes.Buffer
+	err = Message{Parts: Parts{file}}.Into(&buf)
+	if err == nil {
+		err = HandleEmailFromReader(&buf, func(header textproto.MIMEHeader, r io.Reader) (err error) {
+			body, err = ioutil.ReadAll(r)
+			return
+		})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != pdf {
+		t.Errorf("Invalid body:\n\tGot:%d bytes\n\tWant:%d bytes\n", len(body), len(pdf))
+	}
+}
+
+func TestSniffParsedParts(t *testing.T) {
+	exe := "MZ\x90\x00" + strings.Repeat("\x00", 1000)
+
+	var buf bytes.Buffer
+	err := Message{Parts: Parts{
+		Text{Text: "Please pay the invoice"},
+		File{Name: "invoice.pdf", Reader: strings.NewReader(exe)},
+	}}.Into(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := buf.Bytes()
+
+	want := TypeCheck{Declared: "application/pdf", Detected: "application/vnd.microsoft.portable-executable"}
+
+	// Parser report
+	var report []PartResult
+	ps := &Parser{Report: func(results []PartResult) { report = results }}
+
+	var body []byte
+	err = ps.HandleEmailFromReader(bytes.NewReader(message), func(header textproto.MIMEHeader, r io.Reader) (err error) {
+		check, r, err := SniffContentType(header, r)
+		if err != nil {
+			return
+		}
+		if check.Executable() {
+			body, err = ioutil.ReadAll(r)
+		}
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != exe {
+		t.Errorf("Invalid body after sniffing:\n\tGot:%d bytes\n\tWant:%d bytes\n", len(body), len(exe))
+	}
+
+	if len(report) != 2 || report[1].Type != want || !report[1].Type.Mismatch() || report[0].Type.Mismatch() {
+		t.Errorf("Invalid report:\n\tGot:%+v\n\tWant:%+v\n", report, want)
+	}
+
+	// PartReader
+	pr := NewPartReader(bytes.NewReader(message))
+	pr.Next()
+	leaf, err := pr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if leaf.Type != want {
+		t.Errorf("Invalid leaf type:\n\tGot:%+v\n\tWant:%+v\n", leaf.Type, want)
+	}
+}
@@ -0,0 +1,103 @@
+package mimestream
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// spoolBudget is the memory shared by every spool of a write or parse
+type spoolBudget struct {
+	mu   sync.Mutex
+	free int64
+}
+
+func (b *spoolBudget) reserve(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > b.free {
+		return false
+	}
+	b.free -= n
+	return true
+}
+
+func (b *spoolBudget) release(n int64) {
+	b.mu.Lock()
+	b.free += n
+	b.mu.Unlock()
+}
+
+// spool keeps the bytes in memory while the budget allows, and the rest in a
+// temp file
+type spool struct {
+	budget   *spoolBudget
+	dir      string
+	buf      bytes.Buffer
+	reserved int64
+	file     *os.File
+	fileBuf  *bufio.Writer
+}
+
+// The budget is reserved in blocks as the encoder writes a line at a time
+const spoolBlock = 64 * 1024
+
+func (sp *spool) Write(p []byte) (n int, err error) {
+	if sp.file == nil {
+		need := int64(sp.buf.Len()+len(p)) - sp.reserved
+		if need <= 0 {
+			return sp.buf.Write(p)
+		}
+		if need < spoolBlock {
+			need = spoolBlock
+		}
+		if sp.budget.reserve(need) {
+			sp.reserved += need
+			return sp.buf.Write(p)
+		}
+
+		sp.file, err = ioutil.TempFile(sp.dir, "mimestream-spool")
+		if err != nil {
+			return
+		}
+		sp.fileBuf = bufio.NewWriterSize(sp.file, spoolBlock)
+	}
+	return sp.fileBuf.Write(p)
+}
+
+// reader returns the bytes in the order they were written
+func (sp *spool) reader() (io.Reader, error) {
+	if sp.file == nil {
+		return &sp.buf, nil
+	}
+
+	err := sp.fileBuf.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = sp.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return io.MultiReader(&sp.buf, sp.file), nil
+}
+
+// Close releases the memory and removes the temp file. Closing again does
+// nothing.
+func (sp *spool) Close() error {
+	sp.budget.release(sp.reserved)
+	sp.reserved = 0
+	sp.buf = bytes.Buffer{}
+
+	if sp.file == nil {
+		return nil
+	}
+	name := sp.file.Name()
+	sp.file.Close()
+	sp.file = nil
+	return os.Remove(name)
+}
@@ -15,6 +15,10 @@ type Text struct {
 
 // Add implements the Source interface.
 func (p Text) Add(w *multipart.Writer) error {
+	return p.add(defaultState(), "", w)
+}
+
+func (p Text) add(s *writeState, path string, w *multipart.Writer) error {
 
 	contentType := p.ContentType
 
@@ -23,11 +27,13 @@ func (p Text) Add(w *multipart.Writer) error {
 		contentType = TextPlain
 	}
 
-	quotedPart, err := CreateQuotedPart(w, contentType)
+	part, err := w.CreatePart(quotedPartHeader(contentType))
 	if err != nil {
 		return err
 	}
 
+	quotedPart := quotedprintable.NewWriter(s.progress(path).writer(part))
+
 	var n int
 	n, err = quotedPart.Write([]byte(p.Text))
 	if err != nil {
@@ -40,20 +46,28 @@ func (p Text) Add(w *multipart.Writer) error {
 
 	// Need to close after writing
 	// https://golang.org/pkg/mime/quotedprintable/#Writer.Close
-	quotedPart.Close()
+	return quotedPart.Close()
+}
+
+func (p Text) partSize(s *writeState, path string) (textproto.MIMEHeader, int64, error) {
+	contentType := p.ContentType
+	if contentType == "" {
+		contentType = TextPlain
+	}
+
+	// Text is in memory anyway, so just encode it
+	c := &byteCounter{}
+	quoted := quotedprintable.NewWriter(c)
+	quoted.Write([]byte(p.Text))
+	quoted.Close()
 
-	return err
+	return quotedPartHeader(contentType), c.n, nil
 }
 
 // CreateQuotedPart creates a quoted-printable, wrapped, mime part
 func CreateQuotedPart(writer *multipart.Writer, contentType string) (w *quotedprintable.Writer, err error) {
-	header := textproto.MIMEHeader{
-		"Content-Type":              []string{contentType},
-		"Content-Transfer-Encoding": []string{"quoted-printable"},
-	}
-
 	var part io.Writer
-	part, err = writer.CreatePart(header)
+	part, err = writer.CreatePart(quotedPartHeader(contentType))
 	if err != nil {
 		return
 	}
@@ -61,3 +75,10 @@ func CreateQuotedPart(writer *multipart.Writer, contentType string) (w *quotedpr
 	w = quotedprintable.NewWriter(part)
 	return
 }
+
+func quotedPartHeader(contentType string) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Type":              []string{contentType},
+		"Content-Transfer-Encoding": []string{"quoted-printable"},
+	}
+}
@@ -0,0 +1,234 @@
+package mimestream
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidDecision for a Decision that can not be applied to the part, like
+// dropping the whole message
+var ErrInvalidDecision = errors.New("Mimestream: Invalid transform decision")
+
+// Action of a Decision
+type Action int
+
+const (
+	// Keep the part. Multiparts are descended into, leaves are copied as they
+	// are (or re-encoded if the Body was read from).
+	Keep Action = iota
+
+	// Drop the part (and everything inside a multipart)
+	Drop
+
+	// Replace the part with Decision.Part
+	Replace
+
+	// Modify the body of a leaf with Decision.Modify
+	Modify
+)
+
+// Decision of a Visitor about a part
+type Decision struct {
+	Action Action
+
+	// Header replaces the header of a kept or modified part (optional). The
+	// Content-Transfer-Encoding of a modified part picks how the new body is
+	// encoded: base64 stays base64, anything else becomes quoted-printable.
+	Header textproto.MIMEHeader
+
+	// Part written instead for Replace
+	Part Part
+
+	// Modify returns the new decoded body given the decoded body
+	Modify func(body io.Reader) io.Reader
+}
+
+// TransformPart is a part of the message given to a Visitor
+type TransformPart struct {
+	// Path of the part (see BoundaryFunc). The message itself is "".
+	Path   string
+	Header textproto.MIMEHeader
+
+	// Multipart parts have no Body, their parts are visited next (unless
+	// dropped or replaced)
+	Multipart bool
+
+	// Body is the decoded body of a leaf. It can be peeked at (see
+	// SniffContentType) before any Decision, but what is read is gone for Keep
+	// and Modify. A replacement Part may stream it.
+	Body *bufio.Reader
+}
+
+// Visitor decides what happens to each part. The message itself (Path "")
+// can only be kept or modified.
+type Visitor func(p *TransformPart) (Decision, error)
+
+// Transform copies the message from r to w through visit without buffering
+// it. The multipart structure is kept with new boundaries.
+func Transform(r io.Reader, w io.Writer, visit Visitor) error {
+	return (&Writer{}).Transform(context.Background(), r, w, visit)
+}
+
+// Transform is the package level Transform using the Writer options for
+// boundaries and parts written by Replace
+func (wr *Writer) Transform(ctx context.Context, r io.Reader, w io.Writer, visit Visitor) (err error) {
+	s := &writeState{opts: wr, ctx: ctx}
+
+	defer interruptRead(ctx, r)()
+	defer interruptWrite(ctx, w)()
+
+	err = rewriteMessage(s, &contextReader{ctx: ctx, r: r}, w, &visitorRewriter{visit: visit})
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return
+}
+
+// visitorRewriter applies the Decisions of a Visitor
+type visitorRewriter struct {
+	visit Visitor
+}
+
+func (v *visitorRewriter) multipart(path string, header textproto.MIMEHeader) (out partOutput, err error) {
+	var d Decision
+	d, err = v.visit(&TransformPart{Path: path, Header: header, Multipart: true})
+	if err != nil {
+		return
+	}
+
+	switch d.Action {
+	case Keep, Modify:
+		out = partOutput{header: header, descend: true}
+		if d.Header != nil {
+			out.header = d.Header
+		}
+	case Replace:
+		if path == "" || d.Part == nil {
+			err = ErrInvalidDecision
+		}
+		out.part = d.Part
+	case Drop:
+		if path == "" {
+			err = ErrInvalidDecision
+		}
+	default:
+		err = ErrInvalidDecision
+	}
+	return
+}
+
+func (v *visitorRewriter) leaf(path string, header textproto.MIMEHeader, raw io.Reader) (out partOutput, err error) {
+	tracked := &readTracker{r: raw}
+	body := contentDecoderReader(header, tracked)
+
+	var d Decision
+	d, err = v.visit(&TransformPart{Path: path, Header: header, Body: body})
+	if err != nil {
+		return
+	}
+
+	newHeader := header
+	if d.Header != nil {
+		newHeader = d.Header
+	}
+
+	switch d.Action {
+	case Keep:
+		out.header = newHeader
+
+		// Nothing was read, so the original bytes are still there (and still
+		// right unless the Header changes their encoding)
+		sameEncoding := strings.EqualFold(
+			strings.TrimSpace(newHeader.Get("Content-Transfer-Encoding")),
+			strings.TrimSpace(header.Get("Content-Transfer-Encoding")))
+		if !tracked.read && sameEncoding {
+			out.write = func(w io.Writer) error {
+				_, err := io.Copy(w, raw)
+				return err
+			}
+			break
+		}
+
+		out.write = func(w io.Writer) error {
+			return encodeBody(w, newHeader, body)
+		}
+
+	case Modify:
+		if d.Modify == nil {
+			err = ErrInvalidDecision
+			break
+		}
+
+		out.header = modifiedHeader(newHeader)
+		out.write = func(w io.Writer) error {
+			return encodeBody(w, out.header, d.Modify(body))
+		}
+
+	case Replace:
+		if path == "" || d.Part == nil {
+			err = ErrInvalidDecision
+		}
+		out.part = d.Part
+
+	case Drop:
+		if path == "" {
+			err = ErrInvalidDecision
+		}
+
+	default:
+		err = ErrInvalidDecision
+	}
+	return
+}
+
+// modifiedHeader is a copy of the header encoding the new body as base64 or
+// quoted-printable
+func modifiedHeader(header textproto.MIMEHeader) textproto.MIMEHeader {
+	copied := textproto.MIMEHeader{}
+	for k, v := range header {
+		copied[k] = v
+	}
+
+	if !strings.EqualFold(copied.Get("Content-Transfer-Encoding"), "base64") {
+		copied.Set("Content-Transfer-Encoding", "quoted-printable")
+	}
+	return copied
+}
+
+// encodeBody writes the decoded body with the Content-Transfer-Encoding of
+// the header
+func encodeBody(w io.Writer, header textproto.MIMEHeader, body io.Reader) (err error) {
+	var enc io.WriteCloser
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		enc = NewMimeBase64Writer(w)
+	case "quoted-printable":
+		enc = quotedprintable.NewWriter(w)
+	default:
+		_, err = io.Copy(w, body)
+		return
+	}
+
+	_, err = io.Copy(enc, body)
+	if err != nil {
+		return
+	}
+	return enc.Close()
+}
+
+// readTracker records if anything was read
+type readTracker struct {
+	r    io.Reader
+	read bool
+}
+
+func (t *readTracker) Read(p []byte) (int, error) {
+	t.read = true
+	return t.r.Read(p)
+}
@@ -0,0 +1,249 @@
+package mimestream
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTransform(t *testing.T) {
+	var buf bytes.Buffer
+	err := (&Writer{Boundary: HashBoundaries("original")}).WriteMessage(&buf, Message{
+		Header: textproto.MIMEHeader{"Subject": []string{"Transform"}},
+		Parts: Parts{
+			Alternative{Parts: Parts{
+				Text{Text: "Hello"},
+				Text{Text: "<p>Hello</p>", ContentType: TextHTML},
+			}},
+			File{Name: "photo.jpg", Reader: strings.NewReader("jpg")},
+			Mixed{Parts: Parts{
+				Text{Text: "<p>Nested</p>", ContentType: TextHTML},
+				File{Name: "report.pdf", Reader: strings.NewReader("pdf")},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := buf.Bytes()
+
+	footer := "<p>Scanned</p>"
+
+	var visited []string
+	visit := func(p *TransformPart) (Decision, error) {
+		visited = append(visited, p.Path)
+
+		switch {
+		case p.Path == "":
+			header := textproto.MIMEHeader{}
+			for k, v := range p.Header {
+				header[k] = v
+			}
+			header.Set("X-Scanned", "yes")
+			return Decision{Header: header}, nil
+
+		case partFilename(p.Header) == "photo.jpg":
+			return Decision{Action: Replace, Part: Text{Text: "photo removed"}}, nil
+
+		case partFilename(p.Header) != "":
+			return Decision{Action: Drop}, nil
+
+		case strings.HasPrefix(p.Header.Get("Content-Type"), "text/html"):
+			return Decision{Action: Modify, Modify: func(body io.Reader) io.Reader {
+				return io.MultiReader(body, strings.NewReader(footer))
+			}}, nil
+		}
+		return Decision{}, nil
+	}
+
+	wr := &Writer{Boundary: HashBoundaries("transformed")}
+
+	var out bytes.Buffer
+	err = wr.Transform(context.Background(), bytes.NewReader(original), &out, visit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantVisited := "/1/1.1/1.2/2/3/3.1/3.2"
+	if got := strings.Join(visited, "/"); got != wantVisited {
+		t.Errorf("Invalid parts visited:\n\tGot:%s\n\tWant:%s\n", got, wantVisited)
+	}
+
+	if bytes.Contains(out.Bytes(), []byte(HashBoundaries("original")(""))) {
+		t.Error("Original boundary kept")
+	}
+
+	var topHeader textproto.MIMEHeader
+	var bodies []string
+	tp := textproto.NewReader(bufioReader(bytes.NewReader(out.Bytes())))
+	topHeader, _ = tp.ReadMIMEHeader()
+
+	err = HandleEmailFromReader(bytes.NewReader(out.Bytes()), func(header textproto.MIMEHeader, body io.Reader) error {
+		b, err := ioutil.ReadAll(body)
+		bodies = append(bodies, string(b))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"Hello", "<p>Hello</p>" + footer, "photo removed", "<p>Nested</p>" + footer}
+	if strings.Join(bodies, "|") != strings.Join(want, "|") {
+		t.Errorf("Invalid bodies:\n\tGot:%q\n\tWant:%q\n", bodies, want)
+	}
+
+	if topHeader.Get("X-Scanned") != "yes" || topHeader.Get("Subject") != "Transform" {
+		t.Errorf("Invalid top level header:\n\tGot:%v\n", topHeader)
+	}
+
+	// Keeping everything (even after peeking) gives the same bodies
+	var same bytes.Buffer
+	err = Transform(bytes.NewReader(original), &same, func(p *TransformPart) (Decision, error) {
+		if p.Body != nil {
+			p.Body.Peek(2)
+		}
+		return Decision{}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var kept []string
+	HandleEmailFromReader(&same, func(header textproto.MIMEHeader, body io.Reader) error {
+		b, err := ioutil.ReadAll(body)
+		kept = append(kept, string(b))
+		return err
+	})
+	wantKept := "Hello|<p>Hello</p>|jpg|<p>Nested</p>|pdf"
+	if strings.Join(kept, "|") != wantKept {
+		t.Errorf("Invalid bodies:\n\tGot:%q\n\tWant:%q\n", kept, wantKept)
+	}
+
+	// The message itself can not be dropped
+	err = Transform(bytes.NewReader(original), ioutil.Discard, func(p *TransformPart) (Decision, error) {
+		return Decision{Action: Drop}, nil
+	})
+	if err != ErrInvalidDecision {
+		t.Errorf("Invalid error:\n\tGot:%v\n\tWant:%v\n", err, ErrInvalidDecision)
+	}
+}
+
+func TestTransformHeader(t *testing.T) {
+	var ids []string
+	for i := 0; i < 80; i++ {
+		ids = append(ids, fmt.Sprintf("<message-%d@example.com>", i))
+	}
+	references := strings.Join(ids, " ")
+
+	message := "Received: from b.example by c.example\r\n" +
+		"DKIM-Signature: v=1; d=example.com\r\n" +
+		"Received: from a.example by b.example\r\n" +
+		"References: " + references + "\r\n" +
+		"Subject: Header\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+
+	var buf bytes.Buffer
+	err := Transform(strings.NewReader(message), &buf, func(p *TransformPart) (Decision, error) {
+		return Decision{}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := buf.String()
+
+	// Long values are folded again
+	for _, line := range strings.Split(raw, "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("Invalid line length:\n\tGot:%d\n\tWant:%d\n", len(line), 78)
+		}
+	}
+
+	header, err := textproto.NewReader(bufioReader(&buf)).ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("References") != references {
+		t.Errorf("Invalid References:\n\tGot:%s\n\tWant:%s\n", header.Get("References"), references)
+	}
+
+	// The trace headers stay in order
+	var keys []string
+	for _, line := range strings.Split(raw, "\r\n") {
+		if i := strings.Index(line, ":"); i > 0 && line[0] != ' ' {
+			keys = append(keys, line[:i])
+		}
+	}
+	want := []string{"Received", "Dkim-Signature", "Received", "References", "Subject"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("Invalid header order:\n\tGot:%v\n\tWant:%v\n", keys, want)
+	}
+
+	// And the message size still matches the folded header
+	m := Message{Header: textproto.MIMEHeader{"References": {references}}}
+	size, err := m.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	err = m.Into(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(buf.Len()) {
+		t.Errorf("Invalid size:\n\tGot:%v\n\tWant:%v\n", size, buf.Len())
+	}
+}
+
+func TestTransformEncoding(t *testing.T) {
+	message := "Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Caf=C3=A9\r\n"
+
+	tests := []struct {
+		encoding string
+		raw      string
+	}{
+		{"base64", "Q2Fmw6kNCg=="},
+		{"Quoted-Printable", "Caf=C3=A9\r\n"},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		err := Transform(strings.NewReader(message), &buf, func(p *TransformPart) (Decision, error) {
+			header := textproto.MIMEHeader{}
+			for k, v := range p.Header {
+				header[k] = v
+			}
+			header.Set("Content-Transfer-Encoding", test.encoding)
+			return Decision{Header: header}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		raw := buf.String()
+		if got := raw[strings.Index(raw, "\r\n\r\n")+4:]; got != test.raw {
+			t.Errorf("Invalid %s body:\n\tGot:%q\n\tWant:%q\n", test.encoding, got, test.raw)
+		}
+
+		var body []byte
+		err = HandleEmailFromReader(&buf, func(header textproto.MIMEHeader, r io.Reader) (err error) {
+			body, err = ioutil.ReadAll(r)
+			return
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "Café\r\n" {
+			t.Errorf("Invalid %s decoded body:\n\tGot:%q\n\tWant:%q\n", test.encoding, body, "Café\r\n")
+		}
+	}
+}
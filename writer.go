@@ -0,0 +1,280 @@
+package mimestream
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// BoundaryFunc picks the boundary of the multipart at path. The path is the
+// position in the Parts tree numbered from 1: "" is the top level, "2" the
+// second part and "2.1" the first part inside it.
+type BoundaryFunc func(path string) string
+
+// HashBoundaries derives every boundary from a hash of the seed and the path,
+// so the same Parts always produce the same bytes.
+func HashBoundaries(seed string) BoundaryFunc {
+	return func(path string) string {
+		sum := sha256.Sum256([]byte(seed + "\x00" + path))
+
+		// Same length as the random boundaries of mime/multipart
+		return hex.EncodeToString(sum[:])[:60]
+	}
+}
+
+// Writer writes Parts with extra options. The zero Writer behaves exactly like
+// Parts.Into and Message.Into.
+type Writer struct {
+	// Boundary picks the multipart boundaries (random by default)
+	Boundary BoundaryFunc
+
+	// Progress is called with the progress of every part (optional). It is
+	// called for every chunk read or written so it must be fast. With Workers
+	// it is called from several goroutines.
+	Progress func(ProgressEvent)
+
+	// Workers is the number of File parts base64 encoded at the same time
+	// (optional). Sibling Files are encoded ahead into spools and still
+	// written strictly in order. Only worth it with several CPUs and large
+	// attachments (see BenchmarkIntoWorkers4).
+	Workers int
+
+	// SpoolMemory is the total memory for encoded Files waiting their turn
+	// (defaults to DefaultSpoolMemory). Anything more goes to temp files in
+	// SpoolDir (defaults to os.TempDir).
+	SpoolMemory int64
+	SpoolDir    string
+
+	// Sniff detects the type of every File without a ContentType from its
+	// first bytes, instead of trusting the extension of File.Name. Size then
+	// needs Readers that are an io.ReadSeeker (even with File.Size set).
+	Sniff bool
+
+	// NoPlainText stops Alternative adding a text/plain version of its HTML
+	// when it has none
+	NoPlainText bool
+}
+
+// Into writes the parts to w and closes it. With a Boundary function the top
+// level boundary of w is replaced as well.
+func (wr *Writer) Into(w *multipart.Writer, parts Parts) error {
+	return wr.IntoContext(context.Background(), w, parts)
+}
+
+// IntoContext is Into stopping as soon as ctx is done. Cancellation is checked
+// between parts and between the chunks copied from every Reader, and ctx.Err()
+// is returned.
+//
+// Every File.Closer in parts is called exactly once, written or not. Errors
+// from closing after a failure are returned along with it as a MultiError.
+func (wr *Writer) IntoContext(ctx context.Context, w *multipart.Writer, parts Parts) (err error) {
+	if wr.Boundary != nil {
+		err = w.SetBoundary(wr.Boundary(""))
+		if err != nil {
+			return appendError(err, closeParts(parts))
+		}
+	}
+
+	s := &writeState{opts: wr, ctx: ctx}
+
+	err = s.addParts(w, "", parts)
+	if err != nil {
+		return s.cause(err)
+	}
+	return w.Close()
+}
+
+// WriteMessage writes the complete message to w
+func (wr *Writer) WriteMessage(w io.Writer, m Message) error {
+	return wr.WriteMessageContext(context.Background(), w, m)
+}
+
+// WriteMessageContext is WriteMessage stopping as soon as ctx is done (see
+// IntoContext). A write blocked on a w with deadlines (like a net.Conn) is
+// interrupted as well.
+func (wr *Writer) WriteMessageContext(ctx context.Context, w io.Writer, m Message) (err error) {
+	defer interruptWrite(ctx, w)()
+
+	mw := multipart.NewWriter(w)
+	if wr.Boundary != nil {
+		err = mw.SetBoundary(wr.Boundary(""))
+		if err != nil {
+			return appendError(err, closeParts(m.Parts))
+		}
+	}
+
+	var header textproto.MIMEHeader
+	header, err = m.header(mw.Boundary())
+	if err == nil {
+		err = writeHeader(w, header)
+	}
+	if err != nil {
+		s := &writeState{opts: wr, ctx: ctx}
+		return s.cause(appendError(err, s.closed(closeParts(m.Parts))))
+	}
+
+	return wr.IntoContext(ctx, mw, m.Parts)
+}
+
+// Size is the exact number of bytes Into writes (see Parts.Size)
+func (wr *Writer) Size(parts Parts) (int64, error) {
+	s := &writeState{opts: wr, ctx: context.Background()}
+	return multipartSize(s, "", parts, s.boundary(""))
+}
+
+// MessageSize is the exact number of bytes WriteMessage writes
+func (wr *Writer) MessageSize(m Message) (size int64, err error) {
+	s := &writeState{opts: wr, ctx: context.Background()}
+	boundary := s.boundary("")
+
+	size, err = multipartSize(s, "", m.Parts, boundary)
+	if err != nil {
+		return
+	}
+
+	header, err := m.header(boundary)
+	if err != nil {
+		return
+	}
+
+	// messageHeaderSize counts the blank line ending the header block as well
+	return size + messageHeaderSize(header), nil
+}
+
+// writeState is shared by every part written in one call
+type writeState struct {
+	opts *Writer
+	ctx  context.Context
+
+	// Errors from closing sources, reported along with a cancellation
+	mu       sync.Mutex
+	closeErr error
+
+	inProgress progressParts
+
+	// Shared by the preEncoders of every level
+	once    sync.Once
+	workers chan struct{}
+	budget  *spoolBudget
+}
+
+// stateAdder is implemented by the parts of this package so they receive the
+// Writer options and their path. Other parts are added with Part.Add.
+type stateAdder interface {
+	add(s *writeState, path string, w *multipart.Writer) error
+}
+
+// addParts adds every part to w. A part closes its own sources; after an
+// error (or once the context is done) the parts not started are closed here.
+func (s *writeState) addParts(w *multipart.Writer, path string, parts Parts) (err error) {
+	pe := s.preEncode(path, parts)
+	defer pe.stop()
+
+	for i, part := range parts {
+		err = s.ctx.Err()
+		if err != nil {
+			return appendError(err, s.closed(pe.closeRest(parts, i)))
+		}
+
+		child := childPath(path, i)
+
+		var p *partProgress
+		if job := pe.job(i); job != nil {
+			err = job.write(s, w)
+			p = s.progress(child)
+		} else {
+			p = s.startPart(child, part)
+			if sa, ok := part.(stateAdder); ok {
+				err = sa.add(s, child, w)
+			} else {
+				err = part.Add(w)
+			}
+		}
+
+		s.finishPart(p, err)
+		if err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("failed to add %T part %v", part, part))
+			return appendError(err, s.closed(pe.closeRest(parts, i+1)))
+		}
+	}
+	return
+}
+
+// closed records the errors from closing sources and returns them
+func (s *writeState) closed(err error) error {
+	if err != nil {
+		s.mu.Lock()
+		s.closeErr = appendError(s.closeErr, err)
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// cause replaces the error that stopped the write with ctx.Err() once the
+// context is done, keeping any errors from closing sources
+func (s *writeState) cause(err error) error {
+	if s.ctx.Err() == nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return appendError(s.ctx.Err(), s.closeErr)
+}
+
+// boundary for the multipart at path
+func (s *writeState) boundary(path string) string {
+	if s.opts.Boundary != nil {
+		return s.opts.Boundary(path)
+	}
+	return newBoundary()
+}
+
+// addMultipart writes a nested multipart of the given type, streaming the
+// parts straight into it
+func (s *writeState) addMultipart(w *multipart.Writer, path, contentType string, parts Parts) (err error) {
+	if len(parts) == 0 {
+		return
+	}
+
+	boundary := s.boundary(path)
+
+	var part io.Writer
+	part, err = w.CreatePart(multipartHeader(contentType, boundary))
+	if err != nil {
+		return appendError(err, s.closed(closeParts(parts)))
+	}
+
+	w2 := multipart.NewWriter(s.progress(path).writer(part))
+	err = w2.SetBoundary(boundary)
+	if err != nil {
+		return appendError(err, s.closed(closeParts(parts)))
+	}
+
+	err = s.addParts(w2, path, parts)
+	if err != nil {
+		return
+	}
+
+	return w2.Close()
+}
+
+// childPath of the i-th (from 0) part at path
+func childPath(path string, i int) string {
+	if path == "" {
+		return strconv.Itoa(i + 1)
+	}
+	return path + "." + strconv.Itoa(i+1)
+}
+
+// defaultState is used when a part is added on its own with Part.Add
+func defaultState() *writeState {
+	return &writeState{opts: &Writer{}, ctx: context.Background()}
+}
@@ -1,11 +1,15 @@
 package mimestream
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
+	"net/textproto"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"testing"
@@ -85,3 +89,115 @@ func TestWriter(t *testing.T) {
 	}
 
 }
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+func TestGolden(t *testing.T) {
+
+	data := func() io.Reader {
+		b := make([]byte, 1000)
+		for i := range b {
+			b[i] = byte(i)
+		}
+		return bytes.NewReader(b)
+	}
+
+	tests := []struct {
+		name  string
+		parts func() Parts
+	}{
+		{"text", func() Parts {
+			return Parts{Text{Text: "This is the text that goes in the plain part. It will need to be wrapped to 76 characters and quoted."}}
+		}},
+		{"html", func() Parts {
+			return Parts{Text{ContentType: TextHTML, Text: "<p>This is the text that goes in the plain part. It will need to be wrapped to 76 characters and quoted.</p>"}}
+		}},
+		{"file", func() Parts {
+			return Parts{File{Name: "filename.jpg", Reader: data()}}
+		}},
+		{"file_inline", func() Parts {
+			return Parts{File{Name: "filename-2 שלום.txt", Inline: true, Reader: strings.NewReader("Filename text content")}}
+		}},
+		{"alternative", func() Parts {
+			return Parts{
+				Alternative{
+					Parts: Parts{
+						Text{Text: "Plain"},
+						Text{ContentType: TextHTML, Text: "<p>HTML</p>"},
+					},
+				},
+			}
+		}},
+		{"mixed", func() Parts {
+			return Parts{
+				Mixed{
+					Parts: Parts{
+						Alternative{
+							Parts: Parts{
+								Text{Text: "Plain"},
+								Text{ContentType: TextHTML, Text: "<p>HTML</p>"},
+							},
+						},
+						File{ContentType: "application/json", Name: "payload.json", Reader: strings.NewReader(`{"one":1,"two":2}`)},
+					},
+				},
+			}
+		}},
+		{"form", func() Parts {
+			return Parts{
+				FormField{Name: "title", Value: "Holiday photos"},
+				FormFile{FieldName: "upload", Name: "photo.jpg", Reader: data()},
+			}
+		}},
+	}
+
+	wr := &Writer{Boundary: HashBoundaries("golden")}
+
+	check := func(name string, render func(w io.Writer) error) {
+		var outputs [2]bytes.Buffer
+		for i := range outputs {
+			err := render(&outputs[i])
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+
+		if !bytes.Equal(outputs[0].Bytes(), outputs[1].Bytes()) {
+			t.Errorf("%s: output is not reproducible", name)
+		}
+
+		golden := filepath.Join("testdata", name+".golden")
+		if *update {
+			err := ioutil.WriteFile(golden, outputs[0].Bytes(), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(outputs[0].Bytes(), want) {
+			t.Errorf("%s: output differs from %s:\n%s", name, golden, outputs[0].Bytes())
+		}
+	}
+
+	for _, test := range tests {
+		check(test.name, func(w io.Writer) error {
+			return wr.Into(multipart.NewWriter(w), test.parts())
+		})
+	}
+
+	check("message", func(w io.Writer) error {
+		return wr.WriteMessage(w, Message{
+			Header: textproto.MIMEHeader{
+				"From":    []string{"John <john@example.com>"},
+				"To":      []string{"<user@example.com>"},
+				"Subject": []string{"Golden"},
+			},
+			Parts: tests[len(tests)-2].parts(),
+		})
+	})
+}